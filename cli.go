@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/selvinnsikt/backend/database"
+	"github.com/selvinnsikt/backend/questionpack"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runCommand runs a subcommand and returns the exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "import":
+		return importCommand(args)
+	case "export":
+		return exportCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s', must be 'import' or 'export'\n", name)
+		return 2
+	}
+}
+
+// importCommand loads a csv or json question pack into the database.
+// Exits with 1 if any row could not be imported
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := fs.String("file", "", "csv or json file to import, '-' reads from stdin")
+	format := fs.String("format", "", "'csv' or 'json', guessed from the file extension if empty")
+	pack := fs.String("pack", "", "slug of the pack, taken from the file if empty")
+	name := fs.String("name", "", "name of the pack if it is created")
+	dryRun := fs.Bool("dry-run", false, "check the file without storing anything")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "-file is required")
+		return 2
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(*file), ".")
+	}
+	if err := questionpack.ValidFormat(*format); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	report, err := questionpack.Import(db, r, *format, database.Pack{Slug: *pack, Name: *name}, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	for _, e := range report.Errors {
+		fmt.Printf("row %d: %s\n", e.Row, e.Message)
+	}
+	if report.DryRun {
+		fmt.Print("dry-run, nothing was stored: ")
+	}
+	fmt.Printf("pack '%s': %d rows, %d new questions, %d existing questions, %d errors\n",
+		report.Pack, report.Rows, report.Created, report.Existing, len(report.Errors))
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// exportCommand writes every active question in a pack as csv or json
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	pack := fs.String("pack", "", "slug of the pack to export")
+	format := fs.String("format", questionpack.FormatJSON, "'csv' or 'json'")
+	file := fs.String("file", "-", "file to write to, '-' writes to stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *pack == "" {
+		fmt.Fprintln(os.Stderr, "-pack is required")
+		return 2
+	}
+	if err := questionpack.ValidFormat(*format); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	p, questions, err := db.ExportPack(*pack)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *file != "-" {
+		f, err := os.Create(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := questionpack.Write(w, *format, p, questions); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,331 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/selvinnsikt/backend/database"
+	"github.com/selvinnsikt/backend/hub"
+	"github.com/selvinnsikt/backend/questionpack"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+	// Largest file ImportPackHandler reads, 10 MB
+	maxImportSize = 10 << 20
+)
+
+var adminToken string
+
+// QuestionPage is one page of questions returned by ListQuestionsHandler
+type QuestionPage struct {
+	Questions []database.Question `json:"questions"`
+	Page      int                 `json:"page"`
+	PerPage   int                 `json:"perPage"`
+	Total     int                 `json:"total"`
+}
+
+// AdminAuth only lets through requests with the header 'Authorization: Bearer <token>'.
+// Every request is rejected when no admin token is configured
+func AdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "the admin API is disabled", http.StatusForbidden)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(adminToken)) != 1 {
+			log.Printf("unauthorized admin request '%s %s' from IP '%s'\n", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListQuestionsHandler returns a page of questions. Takes the query parameters
+// 'page', 'perPage', 'language', 'category', 'pack' and 'active'
+func ListQuestionsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	page, err := intParam(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		http.Error(w, "page must be a number larger than 0", http.StatusBadRequest)
+		return
+	}
+	perPage, err := intParam(q.Get("perPage"), defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		http.Error(w, fmt.Sprintf("perPage must be a number between 1-%d", maxPerPage), http.StatusBadRequest)
+		return
+	}
+
+	o := database.ListOptions{
+		Language: q.Get("language"),
+		Category: q.Get("category"),
+		Pack:     q.Get("pack"),
+		Offset:   (page - 1) * perPage,
+		Limit:    perPage,
+	}
+	if a := q.Get("active"); a != "" {
+		active, err := strconv.ParseBool(a)
+		if err != nil {
+			http.Error(w, "active must be true or false", http.StatusBadRequest)
+			return
+		}
+		o.Active = &active
+	}
+
+	questions, total, err := db.ListQuestions(o)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, QuestionPage{
+		Questions: questions,
+		Page:      page,
+		PerPage:   perPage,
+		Total:     total,
+	})
+}
+
+// GetQuestionHandler returns one question
+func GetQuestionHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := questionID(w, r)
+	if !ok {
+		return
+	}
+	question, err := db.GetQuestion(id)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, question)
+}
+
+// CreateQuestionHandler adds a new active question to the question bank
+func CreateQuestionHandler(w http.ResponseWriter, r *http.Request) {
+	var q database.Question
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "unable to parse question: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	question, err := db.CreateQuestion(q)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	log.Printf("admin created question %d\n", question.ID)
+	writeJSON(w, http.StatusCreated, question)
+}
+
+// UpdateQuestionHandler changes the text, language and category of a question
+func UpdateQuestionHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := questionID(w, r)
+	if !ok {
+		return
+	}
+	var q database.Question
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "unable to parse question: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.ID = id
+	question, err := db.UpdateQuestion(q)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	log.Printf("admin updated question %d\n", question.ID)
+	writeJSON(w, http.StatusOK, question)
+}
+
+// DeactivateQuestionHandler stops the question from being picked in new games
+func DeactivateQuestionHandler(w http.ResponseWriter, r *http.Request) {
+	setQuestionActive(w, r, false)
+}
+
+// ActivateQuestionHandler lets a deactivated question be picked again
+func ActivateQuestionHandler(w http.ResponseWriter, r *http.Request) {
+	setQuestionActive(w, r, true)
+}
+
+func setQuestionActive(w http.ResponseWriter, r *http.Request, active bool) {
+	id, ok := questionID(w, r)
+	if !ok {
+		return
+	}
+	if err := db.SetQuestionActive(id, active); err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	log.Printf("admin set question %d active to %t\n", id, active)
+	GetQuestionHandler(w, r)
+}
+
+// SetQuestionPacksHandler replaces the packs a question is tagged with.
+// Expects a body like {"packs": ["work-team"]}
+func SetQuestionPacksHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := questionID(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Packs []string `json:"packs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "unable to parse packs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.SetQuestionPacks(id, body.Packs); err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	log.Printf("admin tagged question %d with packs %v\n", id, body.Packs)
+	GetQuestionHandler(w, r)
+}
+
+// CreatePackHandler adds a new empty question pack
+func CreatePackHandler(w http.ResponseWriter, r *http.Request) {
+	var p database.Pack
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "unable to parse pack: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.CreatePack(p); err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	log.Printf("admin created pack '%s'\n", p.Slug)
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// ImportPackHandler imports a csv or json file in the request body into the
+// pack in the url. Takes the query parameters 'format', 'name' and 'dryRun'.
+// The format is guessed from the Content-Type if it is not given
+func ImportPackHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = questionpack.FormatJSON
+		if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+			format = questionpack.FormatCSV
+		}
+	}
+	if err := questionpack.ValidFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun := false
+	if d := q.Get("dryRun"); d != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(d); err != nil {
+			http.Error(w, "dryRun must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	file, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("the file can be at most %d MB", maxImportSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	p := database.Pack{Slug: mux.Vars(r)["slug"], Name: q.Get("name")}
+	report, err := questionpack.Import(db, bytes.NewReader(file), format, p, dryRun)
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	log.Printf("admin imported pack '%s' (dry-run: %t): %d created, %d existing, %d errors\n",
+		report.Pack, report.DryRun, report.Created, report.Existing, len(report.Errors))
+	writeJSON(w, http.StatusOK, report)
+}
+
+// ExportPackHandler writes every active question in the pack as a csv or json
+// file. Takes the query parameter 'format', json is the default
+func ExportPackHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = questionpack.FormatJSON
+	}
+	if err := questionpack.ValidFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, questions, err := db.ExportPack(mux.Vars(r)["slug"])
+	if errors.Is(err, database.ErrPackNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+
+	if format == questionpack.FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", p.Slug, format))
+	if err := questionpack.Write(w, format, p, questions); err != nil {
+		log.Println("ERROR - unable to export pack - " + err.Error())
+	}
+}
+
+// HubStatsHandler returns the number of active hubs and how many hub IDs are left
+func HubStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, hub.Stats())
+}
+
+// questionID parses the question ID in the url. Writes an error to the
+// response and returns false if it is invalid
+func questionID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "question ID in url must be a number", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// intParam parses a query parameter, returns the fallback if it is empty
+func intParam(v string, fallback int) (int, error) {
+	if v == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// writeDatabaseError maps errors from the database layer to a status code
+func writeDatabaseError(w http.ResponseWriter, err error) {
+	var validationErr *database.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, database.ErrDuplicateQuestion):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, database.ErrQuestionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		log.Println("ERROR - database - " + err.Error())
+		http.Error(w, "internal database error", http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
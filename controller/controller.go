@@ -2,38 +2,193 @@ package controller
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/selvinnsikt/backend/database"
 	"github.com/selvinnsikt/backend/game"
 	"github.com/selvinnsikt/backend/hub"
 	"github.com/selvinnsikt/backend/model"
+	"io"
+	"log"
 	"net/http"
+	"strings"
 )
 
-// CreateRoom creates a new game room
+var db database.DB
+
+// InitController sets the database used by the handlers and the token
+// required by the admin API. An empty token disables the admin API
+func InitController(d database.DB, token string) {
+	db = d
+	adminToken = token
+}
+
+// CreateRoom creates a new game room. The settings are either sent as a
+// json-object in the body of a POST request, or as query parameters
 func CreateHubHandler(w http.ResponseWriter, r *http.Request) {
 	// Cors
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	// Which questions the hub should use and how the game is played
+	settings, err := parseHubSettings(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Creating a hub
-	h, hubID := hub.NewHub()
+	h, hubID, err := hub.NewHub(settings)
+	if err != nil {
+		log.Println("ERROR - unable to create hub - " + err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	// Init the game
-	go game.InitGame(h)
+	game.InitGame(h)
 
 	// Return response to client with Hub ID
-	json.NewEncoder(w).Encode(model.HubID{Hub: hubID})
+	json.NewEncoder(w).Encode(model.HubID{Hub: hubID, Settings: settings, HostToken: h.HostToken()})
+}
+
+// parseHubSettings reads the settings from the json body of a POST request, or
+// from the query parameters 'language', 'category' and 'pack'. Several packs
+// can be given either as repeated parameters or comma separated. Settings
+// that are not given get the default value. The language, category and packs
+// must exist in the database
+func parseHubSettings(r *http.Request) (model.HubSettings, error) {
+	s := model.HubSettings{Game: model.DefaultGameSettings()}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil && err != io.EOF {
+			return s, fmt.Errorf("unable to parse settings: %s", err.Error())
+		}
+	} else {
+		q := r.URL.Query()
+		s.Language = q.Get("language")
+		s.Category = q.Get("category")
+		for _, p := range q["pack"] {
+			for _, slug := range strings.Split(p, ",") {
+				if slug = strings.TrimSpace(slug); slug != "" {
+					s.Packs = append(s.Packs, slug)
+				}
+			}
+		}
+	}
+	if s.Language == "" {
+		s.Language = model.DEFAULT_LANGUAGE
+	}
+	if err := s.Game.Validate(); err != nil {
+		return s, err
+	}
+
+	languages, err := db.GetLanguages()
+	if err != nil {
+		return s, err
+	}
+	if !containsLanguage(languages, s.Language) {
+		return s, fmt.Errorf("'%s' is not a valid language", s.Language)
+	}
+
+	if s.Category != "" {
+		categories, err := db.GetCategories()
+		if err != nil {
+			return s, err
+		}
+		if !containsString(categories, s.Category) {
+			return s, fmt.Errorf("'%s' is not a valid category", s.Category)
+		}
+	}
+
+	if len(s.Packs) > 0 {
+		packs, err := db.GetPacks()
+		if err != nil {
+			return s, err
+		}
+		for _, slug := range s.Packs {
+			if !containsPack(packs, slug) {
+				return s, fmt.Errorf("'%s' is not a valid pack", slug)
+			}
+		}
+	}
+	return s, nil
 }
 
-var upgrader = websocket.Upgrader{}
+// QuestionOptionsHandler lists the languages, categories and packs a hub can be created with
+func QuestionOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Cors
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	languages, err := db.GetLanguages()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	categories, err := db.GetCategories()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	packs, err := db.GetPacks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Languages  []database.Language `json:"languages"`
+		Categories []string            `json:"categories"`
+		Packs      []database.Pack     `json:"packs"`
+	}{languages, categories, packs})
+}
+
+func containsLanguage(languages []database.Language, code string) bool {
+	for _, l := range languages {
+		if l.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPack(packs []database.Pack, slug string) bool {
+	for _, p := range packs {
+		if p.Slug == slug {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Super shady origin check. Look under Origin Considerations here:
+// https://godoc.org/github.com/gorilla/websocket for documentation on
+// how to write a better one
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
 
 func JoinRoomHandler(w http.ResponseWriter, r *http.Request) {
 	// Parsing the request
 	vars := mux.Vars(r)
 	np := model.NewPlayer{
-		Name:  vars["player"],
-		HubID: vars["hub"],
+		Name:      vars["player"],
+		HubID:     vars["hub"],
+		HostToken: r.URL.Query().Get("hostToken"),
 	}
 	if np.Name == "" {
 		http.Error(w, "player name in url is empty", http.StatusBadRequest)
@@ -46,16 +201,15 @@ func JoinRoomHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Trying to join the room
 	h, err := hub.ValidateHubAndPlayerName(np)
+	if err == hub.ErrHubLocked {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Super shady origin check. Look under Origin Considerations here:
-	// https://godoc.org/github.com/gorilla/websocket for documentation on
-	// how to write a better one
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-
 	// Upgrades connection from HTTP to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -63,9 +217,78 @@ func JoinRoomHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.AddClientToHub(model.PlayerConnection{
+	err = h.AddClientToHub(model.PlayerConnection{
+		Name:      np.Name,
+		Conn:      conn,
+		HostToken: np.HostToken,
+	})
+	if err != nil {
+		log.Printf("rejected join from IP '%s' - %s\n", r.RemoteAddr, err.Error())
+	}
+
+}
+
+// RejoinRoomHandler attaches a new websocket to a player who lost the
+// connection. The session token from 'ConnectionSuccess' is given in the
+// query parameter 'token'
+func RejoinRoomHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	np := model.NewPlayer{
+		Name:  vars["player"],
+		HubID: vars["hub"],
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "session token is missing", http.StatusBadRequest)
+		return
+	}
+
+	h, err := hub.ValidateRejoin(np, token)
+	if err != nil {
+		log.Printf("rejected rejoin from IP '%s' - %s\n", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = h.RejoinHub(model.PlayerConnection{
 		Name: np.Name,
 		Conn: conn,
-	})
+	}, token)
+	if err != nil {
+		log.Printf("rejected rejoin from IP '%s' - %s\n", r.RemoteAddr, err.Error())
+	}
+}
+
+// SpectateHandler attaches a websocket that gets every broadcast of the hub,
+// but can not play
+func SpectateHandler(w http.ResponseWriter, r *http.Request) {
+	attachViewer(w, r, model.ROLE_SPECTATOR)
+}
+
+// DisplayHandler attaches a big screen that gets the display events on top
+// of every broadcast of the hub
+func DisplayHandler(w http.ResponseWriter, r *http.Request) {
+	attachViewer(w, r, model.ROLE_DISPLAY)
+}
+
+func attachViewer(w http.ResponseWriter, r *http.Request, role string) {
+	h, err := hub.ValidateViewer(mux.Vars(r)["hub"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	h.AddViewerToHub(conn, role)
 }
@@ -1,17 +1,224 @@
 package database
 
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	// Registers the sqlite3 driver used by default
+	_ "github.com/mattn/go-sqlite3"
+)
+
 type DB interface {
-	GetQuestions() ([]string,error)
+	// GetQuestions returns n random active questions
+	GetQuestions(n int) ([]string, error)
+	// SelectQuestions returns random active questions matching the filter
+	SelectQuestions(f QuestionFilter) ([]PickedQuestion, error)
+	GetLanguages() ([]Language, error)
+	GetCategories() ([]string, error)
+	GetPacks() ([]Pack, error)
+
+	// Managing the question bank
+	ListQuestions(o ListOptions) ([]Question, int, error)
+	GetQuestion(id int64) (Question, error)
+	CreateQuestion(q Question) (Question, error)
+	UpdateQuestion(q Question) (Question, error)
+	SetQuestionActive(id int64, active bool) error
+	SetQuestionPacks(id int64, packs []string) error
+	CreatePack(p Pack) error
+	GetPack(slug string) (Pack, error)
+	ImportQuestions(p Pack, rows []ImportRow, dryRun bool) (ImportReport, error)
+	ExportPack(slug string) (Pack, []Question, error)
+}
+
+// QuestionFilter narrows down which questions are picked. Empty fields
+// are not used for filtering
+type QuestionFilter struct {
+	// Language code, e.g. 'no' or 'en'
+	Language string
+	Category string
+	// Slugs of the packs, a question must be in at least one of them
+	Packs []string
+	// IDs of questions that must not be picked, e.g. questions already played
+	Exclude []int64
+	// Number of questions to pick
+	Limit int
+}
+
+// PickedQuestion is a question picked for a game
+type PickedQuestion struct {
+	ID   int64
+	Text string
 }
 
-// TODO: add connection to this struct
-type database struct{}
+type Language struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
 
-func NewDatabase() *database {
-	return &database{}
+type Pack struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
 }
 
-// TODO: implement database layer
-func (db *database) GetQuestions() ([]string, error) {
-	return []string{"first question?", "second question?", "third question?", "fourth question?"}, nil
+// ErrNotEnoughQuestions is returned when the store has fewer questions than requested
+var ErrNotEnoughQuestions = errors.New("not enough questions in the database")
+
+// SQLDatabase is a DB backed by a database/sql connection
+type SQLDatabase struct {
+	conn   *sql.DB
+	driver string
+}
+
+// Open connects to the database and runs all migrations that are not yet applied
+func Open(driver, dsn string) (*SQLDatabase, error) {
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database: %s", err.Error())
+	}
+	if driver == "sqlite3" {
+		// sqlite only allows one writer, and every connection to an in-memory
+		// database gets its own database
+		conn.SetMaxOpenConns(1)
+	}
+	if err = conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to database: %s", err.Error())
+	}
+
+	db := &SQLDatabase{conn: conn, driver: driver}
+	if err = db.Migrate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Printf("connected to %s database\n", driver)
+	return db, nil
+}
+
+// Close closes the connection to the database
+func (db *SQLDatabase) Close() error {
+	return db.conn.Close()
+}
+
+// GetQuestions picks n random active questions from the questions table
+func (db *SQLDatabase) GetQuestions(n int) ([]string, error) {
+	picked, err := db.SelectQuestions(QuestionFilter{Limit: n})
+	if err != nil {
+		return nil, err
+	}
+	questions := make([]string, len(picked))
+	for i, q := range picked {
+		questions[i] = q.Text
+	}
+	return questions, nil
+}
+
+// SelectQuestions picks random active questions matching the filter
+func (db *SQLDatabase) SelectQuestions(f QuestionFilter) ([]PickedQuestion, error) {
+	query := `SELECT q.id, q.text FROM questions q WHERE q.active = 1`
+	var args []interface{}
+	if f.Language != "" {
+		query += ` AND q.language_code = ?`
+		args = append(args, f.Language)
+	}
+	if f.Category != "" {
+		query += ` AND q.category_id = (SELECT id FROM categories WHERE name = ?)`
+		args = append(args, f.Category)
+	}
+	if len(f.Packs) > 0 {
+		query += ` AND q.id IN (SELECT pq.question_id FROM pack_questions pq JOIN packs p ON p.id = pq.pack_id
+			WHERE p.slug IN (?` + strings.Repeat(`, ?`, len(f.Packs)-1) + `))`
+		for _, p := range f.Packs {
+			args = append(args, p)
+		}
+	}
+	if len(f.Exclude) > 0 {
+		query += ` AND q.id NOT IN (?` + strings.Repeat(`, ?`, len(f.Exclude)-1) + `)`
+		for _, e := range f.Exclude {
+			args = append(args, e)
+		}
+	}
+	query += ` ORDER BY RANDOM() LIMIT ?`
+	args = append(args, f.Limit)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var questions []PickedQuestion
+	for rows.Next() {
+		var q PickedQuestion
+		if err := rows.Scan(&q.ID, &q.Text); err != nil {
+			return nil, err
+		}
+		questions = append(questions, q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(questions) < f.Limit {
+		return nil, ErrNotEnoughQuestions
+	}
+	return questions, nil
+}
+
+// GetLanguages returns all languages questions can be written in
+func (db *SQLDatabase) GetLanguages() ([]Language, error) {
+	rows, err := db.conn.Query(`SELECT code, name FROM languages ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var languages []Language
+	for rows.Next() {
+		var l Language
+		if err := rows.Scan(&l.Code, &l.Name); err != nil {
+			return nil, err
+		}
+		languages = append(languages, l)
+	}
+	return languages, rows.Err()
+}
+
+// GetCategories returns the name of every category
+func (db *SQLDatabase) GetCategories() ([]string, error) {
+	rows, err := db.conn.Query(`SELECT name FROM categories ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// GetPacks returns every question pack
+func (db *SQLDatabase) GetPacks() ([]Pack, error) {
+	rows, err := db.conn.Query(`SELECT slug, name FROM packs ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packs []Pack
+	for rows.Next() {
+		var p Pack
+		if err := rows.Scan(&p.Slug, &p.Name); err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+	return packs, rows.Err()
 }
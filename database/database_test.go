@@ -0,0 +1,116 @@
+package database
+
+import "testing"
+
+func openTestDatabase(t *testing.T) *SQLDatabase {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMigrate(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	v, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != migrations[len(migrations)-1].version {
+		t.Errorf("FAIL - expected schema version %d, got %d", migrations[len(migrations)-1].version, v)
+	}
+
+	// Running the migrations again must not fail or change anything
+	if err := db.Migrate(); err != nil {
+		t.Errorf("FAIL - migrating twice - %s", err.Error())
+	}
+}
+
+func TestGetQuestions(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	q, err := db.GetQuestions(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q) != 4 {
+		t.Errorf("FAIL - expected 4 questions, got %d", len(q))
+	}
+	seen := make(map[string]bool)
+	for _, text := range q {
+		if seen[text] {
+			t.Errorf("FAIL - question '%s' picked twice", text)
+		}
+		seen[text] = true
+	}
+
+	if _, err := db.GetQuestions(1000); err != ErrNotEnoughQuestions {
+		t.Errorf("FAIL - expected %v, got %v", ErrNotEnoughQuestions, err)
+	}
+}
+
+func TestSelectQuestions(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	q, err := db.SelectQuestions(QuestionFilter{Language: "en", Packs: []string{"work-team"}, Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"Who is most likely to answer emails on vacation?": true,
+		"Who has the tidiest desk?":                        true,
+		"Who is most likely to suggest another meeting?":   true,
+		"Who would do best as CEO?":                        true,
+	}
+	for _, picked := range q {
+		if !want[picked.Text] {
+			t.Errorf("FAIL - '%s' is not an english work team question", picked.Text)
+		}
+	}
+
+	if _, err := db.SelectQuestions(QuestionFilter{Language: "no", Category: "work", Limit: 5}); err != ErrNotEnoughQuestions {
+		t.Errorf("FAIL - expected %v, got %v", ErrNotEnoughQuestions, err)
+	}
+}
+
+func TestSelectQuestionsExclude(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	f := QuestionFilter{Language: "en", Packs: []string{"work-team"}, Limit: 2}
+	first, err := db.SelectQuestions(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Exclude = []int64{first[0].ID, first[1].ID}
+
+	// A played question stays excluded after the text is edited
+	edited, err := db.GetQuestion(first[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited.Text += " Really?"
+	if _, err := db.UpdateQuestion(edited); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := db.SelectQuestions(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range second {
+		if q.ID == first[0].ID || q.ID == first[1].ID {
+			t.Errorf("FAIL - excluded question '%s' was picked again", q.Text)
+		}
+	}
+
+	// All four work team questions are now played
+	f.Exclude = append(f.Exclude, second[0].ID, second[1].ID)
+	if _, err := db.SelectQuestions(f); err != ErrNotEnoughQuestions {
+		t.Errorf("FAIL - expected %v, got %v", ErrNotEnoughQuestions, err)
+	}
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrPackNotFound = errors.New("pack not found")
+
+// ImportRow is one question read from an import file
+type ImportRow struct {
+	// Row number in the file, used in the report
+	Row      int
+	Question Question
+}
+
+// RowError describes why a row in an import file was not imported
+type RowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// ImportReport summarizes an import
+type ImportReport struct {
+	Pack   string `json:"pack"`
+	DryRun bool   `json:"dryRun"`
+	Rows   int    `json:"rows"`
+	// New questions added to the question bank
+	Created int `json:"created"`
+	// Questions already in the question bank that were added to the pack
+	Existing int        `json:"existing"`
+	Errors   []RowError `json:"errors"`
+}
+
+// GetPack returns the pack with the given slug
+func (db *SQLDatabase) GetPack(slug string) (Pack, error) {
+	p := Pack{Slug: slug}
+	err := db.conn.QueryRow(`SELECT name FROM packs WHERE slug = ?`, slug).Scan(&p.Name)
+	if err == sql.ErrNoRows {
+		return p, ErrPackNotFound
+	}
+	return p, err
+}
+
+// ImportQuestions adds every valid row to the pack. The pack is created if it
+// does not exist, and questions already in the question bank are only added to
+// the pack. Invalid rows are skipped and reported. On a dry-run everything is
+// checked but nothing is stored
+func (db *SQLDatabase) ImportQuestions(p Pack, rows []ImportRow, dryRun bool) (ImportReport, error) {
+	report := ImportReport{Pack: p.Slug, DryRun: dryRun, Rows: len(rows), Errors: []RowError{}}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	var packID int64
+	err = tx.QueryRow(`SELECT id FROM packs WHERE slug = ?`, p.Slug).Scan(&packID)
+	if err == sql.ErrNoRows {
+		if p.Name == "" {
+			p.Name = p.Slug
+		}
+		packID, err = insertPack(tx, p)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	// Rows with the same text in the same language within the file
+	seen := make(map[string]int)
+	for _, r := range rows {
+		q := r.Question
+		q.ID = 0
+		q.Packs = []string{p.Slug}
+
+		if err := q.Validate(); err != nil {
+			report.Errors = append(report.Errors, RowError{Row: r.Row, Message: err.Error()})
+			continue
+		}
+		key := q.Language + "|" + normalizeText(q.Text)
+		if first, ok := seen[key]; ok {
+			report.Errors = append(report.Errors, RowError{Row: r.Row, Message: fmt.Sprintf("same question as row %d", first)})
+			continue
+		}
+		seen[key] = r.Row
+
+		existing, err := findDuplicate(tx, q)
+		if err != nil {
+			return report, err
+		}
+		if existing != 0 {
+			if err := addToPack(tx, packID, existing); err != nil {
+				return report, err
+			}
+			report.Existing++
+			continue
+		}
+
+		if _, err := insertQuestion(tx, q); err != nil {
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				report.Errors = append(report.Errors, RowError{Row: r.Row, Message: err.Error()})
+				continue
+			}
+			return report, err
+		}
+		report.Created++
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+// ExportPack returns the pack and all of its active questions
+func (db *SQLDatabase) ExportPack(slug string) (Pack, []Question, error) {
+	p, err := db.GetPack(slug)
+	if err != nil {
+		return p, nil, err
+	}
+
+	rows, err := db.conn.Query(`SELECT q.id, q.text, q.language_code, COALESCE(c.name, ''), q.active
+		FROM questions q
+		JOIN pack_questions pq ON pq.question_id = q.id
+		JOIN packs p ON p.id = pq.pack_id
+		LEFT JOIN categories c ON c.id = q.category_id
+		WHERE p.slug = ? AND q.active = 1
+		ORDER BY q.id`, slug)
+	if err != nil {
+		return p, nil, err
+	}
+	defer rows.Close()
+
+	questions := []Question{}
+	for rows.Next() {
+		var q Question
+		if err := rows.Scan(&q.ID, &q.Text, &q.Language, &q.Category, &q.Active); err != nil {
+			return p, nil, err
+		}
+		questions = append(questions, q)
+	}
+	if err := rows.Err(); err != nil {
+		return p, nil, err
+	}
+	return p, questions, db.loadPacks(questions)
+}
+
+// addToPack adds an existing question to the pack if it is not already in it
+func addToPack(tx *sql.Tx, packID, questionID int64) error {
+	var exists int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pack_questions WHERE pack_id = ? AND question_id = ?`, packID, questionID).Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO pack_questions (pack_id, question_id) VALUES (?, ?)`, packID, questionID)
+	return err
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"fmt"
+	"log"
+)
+
+// migration is one versioned change to the schema. Migrations are applied in
+// order and never edited after they are released, add a new one instead
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create languages, categories and questions",
+		statements: []string{
+			`CREATE TABLE languages (
+				code TEXT PRIMARY KEY,
+				name TEXT NOT NULL
+			)`,
+			`CREATE TABLE categories (
+				id   INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL UNIQUE
+			)`,
+			`CREATE TABLE questions (
+				id            INTEGER PRIMARY KEY AUTOINCREMENT,
+				text          TEXT NOT NULL,
+				language_code TEXT NOT NULL REFERENCES languages (code),
+				category_id   INTEGER REFERENCES categories (id),
+				active        BOOLEAN NOT NULL DEFAULT 1,
+				created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX questions_language_active ON questions (language_code, active)`,
+			`INSERT INTO languages (code, name) VALUES ('no', 'Norsk'), ('en', 'English')`,
+			`INSERT INTO categories (name) VALUES ('general')`,
+			`INSERT INTO questions (text, language_code, category_id) VALUES
+				('Hvem er mest sannsynlig til å komme for sent?', 'no', 1),
+				('Hvem er mest sannsynlig til å bli kjent?', 'no', 1),
+				('Hvem ville overlevd lengst på en øde øy?', 'no', 1),
+				('Hvem er mest sannsynlig til å glemme en bursdag?', 'no', 1),
+				('Hvem ville vært den beste sjefen?', 'no', 1),
+				('Hvem er mest sannsynlig til å flytte til utlandet?', 'no', 1),
+				('Who is most likely to be late?', 'en', 1),
+				('Who is most likely to become famous?', 'en', 1),
+				('Who would survive the longest on a desert island?', 'en', 1),
+				('Who is most likely to forget a birthday?', 'en', 1),
+				('Who would make the best boss?', 'en', 1),
+				('Who is most likely to move abroad?', 'en', 1)`,
+		},
+	},
+	{
+		version:     2,
+		description: "create question packs",
+		statements: []string{
+			`CREATE TABLE packs (
+				id   INTEGER PRIMARY KEY AUTOINCREMENT,
+				slug TEXT NOT NULL UNIQUE,
+				name TEXT NOT NULL
+			)`,
+			`CREATE TABLE pack_questions (
+				pack_id     INTEGER NOT NULL REFERENCES packs (id),
+				question_id INTEGER NOT NULL REFERENCES questions (id),
+				PRIMARY KEY (pack_id, question_id)
+			)`,
+			`INSERT INTO packs (slug, name) VALUES
+				('old-friends', 'Old friends'),
+				('family-friendly', 'Family-friendly'),
+				('work-team', 'Work team')`,
+			`INSERT INTO categories (name) VALUES ('work')`,
+			`INSERT INTO questions (text, language_code, category_id) VALUES
+				('Hvem er mest sannsynlig til å svare på e-post i ferien?', 'no', 2),
+				('Hvem har det ryddigste skrivebordet?', 'no', 2),
+				('Hvem er mest sannsynlig til å foreslå et nytt møte?', 'no', 2),
+				('Hvem ville klart seg best som administrerende direktør?', 'no', 2),
+				('Who is most likely to answer emails on vacation?', 'en', 2),
+				('Who has the tidiest desk?', 'en', 2),
+				('Who is most likely to suggest another meeting?', 'en', 2),
+				('Who would do best as CEO?', 'en', 2)`,
+			// Every general question fits old friends and families, the
+			// work questions are only in the work team pack
+			`INSERT INTO pack_questions (pack_id, question_id)
+				SELECT p.id, q.id FROM packs p, questions q, categories c
+				WHERE q.category_id = c.id AND c.name = 'general' AND p.slug IN ('old-friends', 'family-friendly')`,
+			`INSERT INTO pack_questions (pack_id, question_id)
+				SELECT p.id, q.id FROM packs p, questions q, categories c
+				WHERE q.category_id = c.id AND c.name = 'work' AND p.slug = 'work-team'`,
+		},
+	},
+}
+
+// Migrate applies every migration newer than the current schema version
+func (db *SQLDatabase) Migrate() error {
+	_, err := db.conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("unable to create schema_migrations: %s", err.Error())
+	}
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := db.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d '%s' failed: %s", m.version, m.description, err.Error())
+		}
+		log.Printf("applied database migration %d '%s'\n", m.version, m.description)
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the last applied migration
+func (db *SQLDatabase) SchemaVersion() (int, error) {
+	var version int
+	err := db.conn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read schema version: %s", err.Error())
+	}
+	return version, nil
+}
+
+// applyMigration runs all statements of the migration in one transaction
+func (db *SQLDatabase) applyMigration(m migration) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range m.statements {
+		if _, err := tx.Exec(s); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, description) VALUES (?, ?)`, m.version, m.description)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,400 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxQuestionLength is the maximum number of characters in a question
+const MaxQuestionLength = 200
+
+var (
+	ErrQuestionNotFound  = errors.New("question not found")
+	ErrDuplicateQuestion = errors.New("question already exists")
+)
+
+// ValidationError is returned when a field of a question or pack is invalid
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+// Question is one question in the question bank
+type Question struct {
+	ID       int64    `json:"id"`
+	Text     string   `json:"text"`
+	Language string   `json:"language"`
+	Category string   `json:"category,omitempty"`
+	Packs    []string `json:"packs"`
+	Active   bool     `json:"active"`
+}
+
+// ListOptions filters and paginates the questions returned by ListQuestions.
+// Empty fields are not used for filtering
+type ListOptions struct {
+	Language string
+	Category string
+	Pack     string
+	// Active only lists active or inactive questions, nil lists both
+	Active *bool
+	Offset int
+	Limit  int
+}
+
+// Validate checks the fields of the question that do not need the database
+func (q *Question) Validate() error {
+	q.Text = strings.TrimSpace(q.Text)
+	if q.Text == "" {
+		return &ValidationError{Field: "text", Message: "must not be empty"}
+	}
+	if n := utf8.RuneCountInString(q.Text); n > MaxQuestionLength {
+		return &ValidationError{Field: "text", Message: fmt.Sprintf("is %d characters, maximum is %d", n, MaxQuestionLength)}
+	}
+	if q.Language == "" {
+		return &ValidationError{Field: "language", Message: "must not be empty"}
+	}
+	return nil
+}
+
+// ListQuestions returns one page of questions ordered by ID and the total
+// number of questions matching the options
+func (db *SQLDatabase) ListQuestions(o ListOptions) ([]Question, int, error) {
+	where := ` WHERE 1 = 1`
+	var args []interface{}
+	if o.Language != "" {
+		where += ` AND q.language_code = ?`
+		args = append(args, o.Language)
+	}
+	if o.Category != "" {
+		where += ` AND c.name = ?`
+		args = append(args, o.Category)
+	}
+	if o.Pack != "" {
+		where += ` AND q.id IN (SELECT pq.question_id FROM pack_questions pq JOIN packs p ON p.id = pq.pack_id WHERE p.slug = ?)`
+		args = append(args, o.Pack)
+	}
+	if o.Active != nil {
+		where += ` AND q.active = ?`
+		args = append(args, *o.Active)
+	}
+	from := ` FROM questions q LEFT JOIN categories c ON c.id = q.category_id`
+
+	var total int
+	if err := db.conn.QueryRow(`SELECT COUNT(*)`+from+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.conn.Query(`SELECT q.id, q.text, q.language_code, COALESCE(c.name, ''), q.active`+from+where+
+		` ORDER BY q.id LIMIT ? OFFSET ?`, append(args, o.Limit, o.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	questions := []Question{}
+	for rows.Next() {
+		var q Question
+		if err := rows.Scan(&q.ID, &q.Text, &q.Language, &q.Category, &q.Active); err != nil {
+			return nil, 0, err
+		}
+		questions = append(questions, q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := db.loadPacks(questions); err != nil {
+		return nil, 0, err
+	}
+	return questions, total, nil
+}
+
+// GetQuestion returns the question with the given ID
+func (db *SQLDatabase) GetQuestion(id int64) (Question, error) {
+	q := Question{ID: id}
+	err := db.conn.QueryRow(`SELECT q.text, q.language_code, COALESCE(c.name, ''), q.active
+		FROM questions q LEFT JOIN categories c ON c.id = q.category_id WHERE q.id = ?`, id).
+		Scan(&q.Text, &q.Language, &q.Category, &q.Active)
+	if err == sql.ErrNoRows {
+		return q, ErrQuestionNotFound
+	}
+	if err != nil {
+		return q, err
+	}
+	questions := []Question{q}
+	if err := db.loadPacks(questions); err != nil {
+		return q, err
+	}
+	return questions[0], nil
+}
+
+// CreateQuestion validates and stores a new active question
+func (db *SQLDatabase) CreateQuestion(q Question) (Question, error) {
+	if err := q.Validate(); err != nil {
+		return q, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return q, err
+	}
+	defer tx.Rollback()
+
+	if q.ID, err = insertQuestion(tx, q); err != nil {
+		return q, err
+	}
+	if err := tx.Commit(); err != nil {
+		return q, err
+	}
+	return db.GetQuestion(q.ID)
+}
+
+// insertQuestion checks and inserts a validated question, returns the new ID
+func insertQuestion(tx *sql.Tx, q Question) (int64, error) {
+	categoryID, err := checkQuestion(tx, q)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`INSERT INTO questions (text, language_code, category_id) VALUES (?, ?, ?)`, q.Text, q.Language, categoryID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, setPacks(tx, id, q.Packs)
+}
+
+// UpdateQuestion changes the text, language and category of the question.
+// Packs and whether the question is active are not changed
+func (db *SQLDatabase) UpdateQuestion(q Question) (Question, error) {
+	if err := q.Validate(); err != nil {
+		return q, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return q, err
+	}
+	defer tx.Rollback()
+
+	categoryID, err := checkQuestion(tx, q)
+	if err != nil {
+		return q, err
+	}
+
+	res, err := tx.Exec(`UPDATE questions SET text = ?, language_code = ?, category_id = ? WHERE id = ?`, q.Text, q.Language, categoryID, q.ID)
+	if err != nil {
+		return q, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return q, err
+	} else if n == 0 {
+		return q, ErrQuestionNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return q, err
+	}
+	return db.GetQuestion(q.ID)
+}
+
+// SetQuestionActive activates or deactivates a question. Inactive questions
+// are never picked for a game
+func (db *SQLDatabase) SetQuestionActive(id int64, active bool) error {
+	res, err := db.conn.Exec(`UPDATE questions SET active = ? WHERE id = ?`, active, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrQuestionNotFound
+	}
+	return nil
+}
+
+// SetQuestionPacks replaces the packs the question is tagged with
+func (db *SQLDatabase) SetQuestionPacks(id int64, packs []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM questions WHERE id = ?`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrQuestionNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM pack_questions WHERE question_id = ?`, id); err != nil {
+		return err
+	}
+	if err := setPacks(tx, id, packs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreatePack stores a new, empty question pack
+func (db *SQLDatabase) CreatePack(p Pack) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := insertPack(tx, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertPack validates and inserts the pack, returns the new ID
+func insertPack(tx *sql.Tx, p Pack) (int64, error) {
+	p.Slug = strings.TrimSpace(p.Slug)
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Slug == "" || strings.ContainsAny(p.Slug, " ,") {
+		return 0, &ValidationError{Field: "slug", Message: "must be non-empty without spaces or commas"}
+	}
+	if p.Name == "" {
+		return 0, &ValidationError{Field: "name", Message: "must not be empty"}
+	}
+	var exists int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM packs WHERE slug = ?`, p.Slug).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists > 0 {
+		return 0, &ValidationError{Field: "slug", Message: fmt.Sprintf("pack '%s' already exists", p.Slug)}
+	}
+	res, err := tx.Exec(`INSERT INTO packs (slug, name) VALUES (?, ?)`, p.Slug, p.Name)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// checkQuestion checks that the language and category of the question
+// exist and that no other question has the same text in the same language.
+// Returns the ID of the category or nil if the question has no category
+func checkQuestion(tx *sql.Tx, q Question) (interface{}, error) {
+	var exists int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM languages WHERE code = ?`, q.Language).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, &ValidationError{Field: "language", Message: fmt.Sprintf("'%s' does not exist", q.Language)}
+	}
+
+	var categoryID interface{}
+	if q.Category != "" {
+		var id int64
+		err := tx.QueryRow(`SELECT id FROM categories WHERE name = ?`, q.Category).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, &ValidationError{Field: "category", Message: fmt.Sprintf("'%s' does not exist", q.Category)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		categoryID = id
+	}
+
+	id, err := findDuplicate(tx, q)
+	if err != nil {
+		return nil, err
+	}
+	if id != 0 {
+		return nil, fmt.Errorf("%w: same text as question %d", ErrDuplicateQuestion, id)
+	}
+	return categoryID, nil
+}
+
+// findDuplicate returns the ID of another question with the same normalized
+// text in the same language, or 0 if there is none
+func findDuplicate(tx *sql.Tx, q Question) (int64, error) {
+	rows, err := tx.Query(`SELECT id, text FROM questions WHERE language_code = ? AND id != ?`, q.Language, q.ID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	text := normalizeText(q.Text)
+	for rows.Next() {
+		var id int64
+		var t string
+		if err := rows.Scan(&id, &t); err != nil {
+			return 0, err
+		}
+		if normalizeText(t) == text {
+			return id, nil
+		}
+	}
+	return 0, rows.Err()
+}
+
+// setPacks adds the question to every pack
+func setPacks(tx *sql.Tx, id int64, packs []string) error {
+	added := make(map[string]bool)
+	for _, p := range packs {
+		if added[p] {
+			continue
+		}
+		var packID int64
+		err := tx.QueryRow(`SELECT id FROM packs WHERE slug = ?`, p).Scan(&packID)
+		if err == sql.ErrNoRows {
+			return &ValidationError{Field: "packs", Message: fmt.Sprintf("'%s' does not exist", p)}
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO pack_questions (pack_id, question_id) VALUES (?, ?)`, packID, id); err != nil {
+			return err
+		}
+		added[p] = true
+	}
+	return nil
+}
+
+// loadPacks sets the packs of every question
+func (db *SQLDatabase) loadPacks(questions []Question) error {
+	if len(questions) == 0 {
+		return nil
+	}
+	index := make(map[int64]int, len(questions))
+	args := make([]interface{}, len(questions))
+	for i, q := range questions {
+		index[q.ID] = i
+		args[i] = q.ID
+		questions[i].Packs = []string{}
+	}
+	rows, err := db.conn.Query(`SELECT pq.question_id, p.slug FROM pack_questions pq JOIN packs p ON p.id = pq.pack_id
+		WHERE pq.question_id IN (?`+strings.Repeat(`, ?`, len(questions)-1)+`) ORDER BY p.slug`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var slug string
+		if err := rows.Scan(&id, &slug); err != nil {
+			return err
+		}
+		questions[index[id]].Packs = append(questions[index[id]].Packs, slug)
+	}
+	return rows.Err()
+}
+
+// normalizeText lower cases the text and collapses whitespace
+func normalizeText(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
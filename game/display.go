@@ -0,0 +1,110 @@
+package game
+
+import (
+	"github.com/selvinnsikt/backend/model"
+	"sort"
+)
+
+// revealStep is how long a display shows each vote tally before the next
+const revealStep = 1500
+
+// broadcastProgress tells the displays who the game is waiting for. Does
+// nothing outside the phases where players submit
+func (g *Game) broadcastProgress() {
+	phase := g.Phase()
+	if phase != Voting && phase != SelfVoting {
+		return
+	}
+	players := g.activeParticipants()
+	g.ag.mutex.RLock()
+	m := model.DisplayProgress{
+		PayloadType: model.PayloadType{Type: model.DISPLAY_PROGRESS},
+		Phase:       string(phase),
+		Questions:   make([]model.QuestionProgress, 0, len(g.ag.rounds)),
+	}
+	for i, r := range g.ag.rounds {
+		q := model.QuestionProgress{
+			Question:  i + 1,
+			Text:      r.question,
+			Submitted: []string{},
+			Waiting:   []string{},
+		}
+		for _, p := range g.ag.participants {
+			if submitted(r, p, phase) {
+				q.Submitted = append(q.Submitted, p)
+			}
+		}
+		for _, p := range players {
+			if !submitted(r, p, phase) && !(phase == SelfVoting && r.done) {
+				q.Waiting = append(q.Waiting, p)
+			}
+		}
+		m.Questions = append(m.Questions, q)
+	}
+	g.ag.mutex.RUnlock()
+	g.Hub.BroadcastToRole(m, model.ROLE_DISPLAY)
+}
+
+// submitted checks if the player has voted or self-voted on the round
+func submitted(r round, player string, phase Phase) bool {
+	var ok bool
+	if phase == Voting {
+		_, ok = r.ballots[player]
+	} else {
+		_, ok = r.selfVotes[player]
+	}
+	return ok
+}
+
+// broadcastReveal sends the displays the votes on the scored question in the
+// order they should be revealed
+func (g *Game) broadcastReveal(question int) {
+	g.ag.mutex.RLock()
+	r := g.ag.rounds[question-1]
+	m := model.DisplayReveal{
+		PayloadType: model.PayloadType{Type: model.DISPLAY_REVEAL},
+		Question:    question,
+		Text:        r.question,
+		Tallies:     make([]model.VoteTally, 0, len(g.ag.participants)),
+		MostVotes:   []string{},
+		StepMillis:  revealStep,
+	}
+	for _, p := range g.ag.participants {
+		m.Tallies = append(m.Tallies, model.VoteTally{
+			Player:   p,
+			Votes:    r.playerVotes[p],
+			Decision: r.selfVotes[p],
+			Points:   r.points[p],
+		})
+	}
+	g.ag.mutex.RUnlock()
+
+	// Fewest votes first, so the players with the most votes are revealed last
+	sort.SliceStable(m.Tallies, func(i, j int) bool {
+		return m.Tallies[i].Votes < m.Tallies[j].Votes
+	})
+	for i := range m.Tallies {
+		m.Tallies[i].Step = i + 1
+	}
+	if n := len(m.Tallies); n > 0 && m.Tallies[n-1].Votes > 0 {
+		for _, t := range m.Tallies {
+			if t.Votes == m.Tallies[n-1].Votes {
+				m.MostVotes = append(m.MostVotes, t.Player)
+			}
+		}
+	}
+	g.Hub.BroadcastToRole(m, model.ROLE_DISPLAY)
+}
+
+// broadcastScoreboard sends the displays the standings so far
+func (g *Game) broadcastScoreboard(final bool) {
+	g.ag.mutex.RLock()
+	m := model.DisplayScoreboard{
+		PayloadType: model.PayloadType{Type: model.DISPLAY_SCOREBOARD},
+		Game:        len(g.history) + 1,
+		Standings:   standings(g.ag.scores),
+		Final:       final,
+	}
+	g.ag.mutex.RUnlock()
+	g.Hub.BroadcastToRole(m, model.ROLE_DISPLAY)
+}
@@ -7,67 +7,147 @@ import (
 	"github.com/selvinnsikt/backend/hub"
 	"github.com/selvinnsikt/backend/model"
 	"log"
+	"sort"
+	"strings"
 	"sync"
-	"time"
 )
 
-// Inits game and listen to a channel which received incoming messages from all
-// clients who are connected to the hub
+// games holds the game of every active hub
+var games *Games
 
-var game *Game
-
-const (
-	REQUIRED_VOTES_PER_QUESTIONS = 2
-)
-
-//
 type Game struct {
 	Hub *hub.Hub
-	// Number of players that have sent ready
-	NumberPlayersReady int
+	// Ready state of every connected player, map[playerName]ready
+	ready map[string]bool
 	// Interface to the database layer
 	Database database.DB
 	// Information about the active game
 	ag activeGame
+	// Current phase of the game, guarded by ag.mutex
+	phase Phase
+	// Results of the earlier games in the hub, guarded by ag.mutex
+	history []model.GameResult
+	// Deadline of the current phase, guarded by ag.mutex
+	timer *phaseTimer
+	// Receives the timer when its deadline runs out
+	timeoutChan chan *phaseTimer
 }
 
 // ActiveGame manages information about the ongoing game
 type activeGame struct {
-	// Question that have been sent to the players
-	questions []string
+	// IDs of the questions that have been sent to the players
+	questions []int64
 	// one activeGame consists of four rounds
 	rounds []round
-	mutex  *sync.RWMutex
+	// Running score of every player, map[playerName]points
+	scores map[string]int
+	// Players in the hub when the game started, in the order they joined
+	participants []string
+	mutex        *sync.RWMutex
 }
 
 type round struct {
+	// The question asked in this round
+	question string
 	// Votes from players for current round
 	playerVotes map[string]int
+	// Votes from each player, map[voter]map[playerName]votes
+	ballots map[string]map[string]int
 	// Self votes from players for current round
 	// map[playerName]decision
 	selfVotes map[string]string
+	// Points given when the self votes were scored
+	points map[string]int
+	// If the self votes are scored
+	done bool
+}
+
+// Games is a registry of games keyed by the ID of the hub they belong to
+type Games struct {
+	activeGames map[string]*Game
+	// Database shared by all the games
+	db database.DB
+	*sync.RWMutex
+}
+
+func InitGames(db database.DB) {
+	games = &Games{
+		activeGames: make(map[string]*Game),
+		db:          db,
+		RWMutex:     &sync.RWMutex{},
+	}
 }
 
-func InitGame(h *hub.Hub) {
+// InitGame creates a game for the hub and listen to a channel which received
+// incoming messages from all clients who are connected to the hub.
+// The game is removed from the registry when the hub is closed
+func InitGame(h *hub.Hub) *Game {
 	// Init game struct
-	game = new(Game)
-	game.Hub = h
-	game.Database = database.NewDatabase()
+	g := new(Game)
+	g.Hub = h
+	g.Database = games.db
 
-	game.ag.mutex = new(sync.RWMutex)
+	g.ag.mutex = new(sync.RWMutex)
+	g.ag.scores = make(map[string]int)
+	g.phase = Lobby
+	g.ready = make(map[string]bool)
+	g.timeoutChan = make(chan *phaseTimer)
+
+	// Register the game on the ID of the hub
+	games.Lock()
+	games.activeGames[h.HubID()] = g
+	games.Unlock()
 
 	// Read messages from Hub
-	go game.readHubMessages()
+	go g.readHubMessages()
+
+	return g
+}
+
+// GetGame returns the game belonging to the hub with the given ID
+func GetGame(hubID string) (*Game, error) {
+	games.RLock()
+	defer games.RUnlock()
+	g, ok := games.activeGames[hubID]
+	if !ok {
+		return nil, fmt.Errorf("did not find any game for hub with id '%s'", hubID)
+	}
+	return g, nil
+}
+
+// NumberOfGames returns how many games are registered
+func NumberOfGames() int {
+	games.RLock()
+	defer games.RUnlock()
+	return len(games.activeGames)
+}
+
+// removeGame deletes the game from the registry
+func removeGame(hubID string) {
+	games.Lock()
+	defer games.Unlock()
+	delete(games.activeGames, hubID)
 }
 
-// readHubMessages reads all messages sent from the broadcast channel
+// readHubMessages reads all messages sent from the broadcast channel until
+// the hub is closed
 func (g *Game) readHubMessages() {
 	broadcastCh := g.Hub.GetBroadcastChan()
 	for {
 		select {
 		case msg := <-broadcastCh:
+			if msg.Event != "" {
+				g.handleHubEvent(msg)
+				continue
+			}
 			log.Println("received message: " + msg.Text)
 			g.handleDataFromHub(msg)
+		case t := <-g.timeoutChan:
+			g.handleTimeout(t)
+		case <-g.Hub.Done():
+			g.setPhase(Finished)
+			removeGame(g.Hub.HubID())
+			return
 		}
 	}
 }
@@ -76,9 +156,16 @@ func (g *Game) handleDataFromHub(msg model.Message) {
 	// get type of payload and index message starts
 	t, i, err := getPayloadType([]byte(msg.Text))
 	if err != nil {
-		g.Hub.SendMsgToClient(fmt.Sprintf("unable to parse message: '%s'", msg.Text), msg.Player)
+		g.sendError(msg.Player, model.ERR_INVALID_MESSAGE, "", "unable to parse message: '%s'", msg.Text)
+		return
+	}
+
+	// Reject messages that are not allowed in this phase of the game
+	if !g.acceptedInPhase(t) {
+		g.sendError(msg.Player, model.ERR_WRONG_PHASE, t, "'%s' is not allowed in phase '%s'", t, g.Phase())
 		return
 	}
+
 	// only get the wanted json-object
 	d := removePayloadType(msg.Text, i)
 
@@ -87,168 +174,279 @@ func (g *Game) handleDataFromHub(msg model.Message) {
 	case model.READY_TO_PLAY:
 		// Parse the raw bytes to the correct struct
 		var m model.ReadyToPlay
-		err = json.Unmarshal(d, &m)
-		if err != nil {
-			g.Hub.SendMsgToClient(fmt.Sprintf("unable to parse json-object '%s' to type '%s' ; error: %s", string(d), t, err.Error()), msg.Player)
+		if !g.parsePayload(msg.Player, t, d, &m) {
 			return
 		}
-		// Add type to the message
-		m.Type = model.READY_TO_PLAY
-
-		// Add playername to the message
-		m.Player = msg.Player
-
-		// If player sent ready or not ready
-		if m.Ready {
-			g.NumberPlayersReady++
-		} else {
-			g.NumberPlayersReady--
-		}
-
-		// Broadcast to other players that the player is ready or not ready
-		g.Hub.BroadcastMsg(m)
-
-		// If everyone is ready
-		if g.Hub.GetNumberOfClientsConnected() == g.NumberPlayersReady {
-			// Starting the game
-			g.beginGame()
-		}
+		g.handleReadyToPlay(msg.Player, m)
 	case model.PLAYERS_VOTE_TO_QUESTION:
 		// Read playerVotes from player
 		var m model.PlayersVotesToQuestion
-		err = json.Unmarshal(d, &m)
-		if err != nil {
-			g.Hub.SendMsgToClient(fmt.Sprintf("unable to parse json-object '%s' to type '%s' ; error: %s", string(d), t, err.Error()), msg.Player)
+		if !g.parsePayload(msg.Player, t, d, &m) {
 			return
 		}
-
-		// Check if the question number is valid
-		// question number must be between 1-4
-		if m.Question < 1 || m.Question > 4 {
-			g.Hub.SendMsgToClient(fmt.Sprintf("%d is a invalid question number, must be between 1-4", m.Question), msg.Player)
+		g.handlePlayersVote(msg.Player, m, false)
+	case model.CHANGE_VOTE:
+		var m model.PlayersVotesToQuestion
+		if !g.parsePayload(msg.Player, t, d, &m) {
 			return
 		}
-
-		// If the sent playerVotes from client is valid
-		if err := isValidNumberOfVotes(m.Votes); err != nil {
-			g.Hub.SendMsgToClient(err.Error(), msg.Player)
+		g.handlePlayersVote(msg.Player, m, true)
+	case model.SELF_VOTE_ON_QUESTION:
+		var m model.SelfVoteOnQuestion
+		if !g.parsePayload(msg.Player, t, d, &m) {
 			return
 		}
+		g.handleSelfVote(msg.Player, m)
+	case model.PLAY_AGAIN:
+		g.handlePlayAgain(msg.Player)
+	case model.KICK_PLAYER, model.LOCK_LOBBY, model.START_GAME, model.TRANSFER_HOST:
+		g.handleHostMessage(msg.Player, t, d)
+	case model.PLAYERS_CONNECTED:
+		g.Hub.SendMsgToClient(model.PlayersConnected{PayloadType: model.PayloadType{Type: model.PLAYERS_CONNECTED}, NumberConnected: g.Hub.GetNumberOfClientsConnected()}, msg.Player)
+	default:
+		g.sendError(msg.Player, model.ERR_UNKNOWN_TYPE, t, "'%s' is not of a valid message type", t)
+	}
+}
 
-		// Add playerVotes to game struct for this round
-		g.ag.mutex.Lock()
-		for player, votes := range m.Votes {
-			// Question slice starts at index 0
-			g.ag.rounds[m.Question-1].playerVotes[player] += votes
-		}
-		g.ag.mutex.Unlock()
+// parsePayload unmarshals the json-object into v. Sends an error to the
+// player and returns false if it is invalid
+func (g *Game) parsePayload(player, t string, d []byte, v interface{}) bool {
+	err := json.Unmarshal(d, v)
+	if err != nil {
+		g.sendError(player, model.ERR_INVALID_MESSAGE, t, "unable to parse json-object '%s' to type '%s' ; error: %s", string(d), t, err.Error())
+		return false
+	}
+	return true
+}
 
-		// Broadcast that a vote was received
-		g.Hub.BroadcastMsg(model.PlayersVotesToQuestionReceived{
-			PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION_RECIEVED},
-			Question:    m.Question,
-			Player:      msg.Player,
-		})
+// sendError sends a typed error to the player
+func (g *Game) sendError(player, code, rejectedType, format string, a ...interface{}) {
+	g.Hub.SendMsgToClient(g.newError(code, rejectedType, format, a...), player)
+}
+
+// newError creates a typed error in the current phase
+func (g *Game) newError(code, rejectedType, format string, a ...interface{}) model.Error {
+	return model.Error{
+		PayloadType:  model.PayloadType{Type: model.ERROR},
+		Code:         code,
+		Message:      fmt.Sprintf(format, a...),
+		Phase:        string(g.Phase()),
+		RejectedType: rejectedType,
+	}
+}
 
-		// Check if the round is done
-		if m.Question == 4 {
-			var totalVotes int
+// handlePlayersVote registers the votes of the player on a question. Every
+// player votes once per question, and must send 'ChangeVote' to replace the votes
+func (g *Game) handlePlayersVote(player string, m model.PlayersVotesToQuestion, change bool) {
+	t := model.PLAYERS_VOTE_TO_QUESTION
+	if change {
+		t = model.CHANGE_VOTE
+	}
 
-			// Counting total playerVotes for last question
-			g.ag.mutex.RLock()
-			for _, votes := range g.ag.rounds[model.MAX_NUMBER_OF_ROUND-1].playerVotes {
-				totalVotes += votes
-			}
-			g.ag.mutex.RUnlock()
+	// Check if the question number is valid
+	// question number must be between 1 and the number of questions
+	settings := g.settings()
+	if m.Question < 1 || m.Question > settings.NumberOfQuestions {
+		g.sendError(player, model.ERR_INVALID_QUESTION, t, "%d is a invalid question number, must be between 1-%d", m.Question, settings.NumberOfQuestions)
+		return
+	}
 
-			// If everyone has voted this last round
-			if totalVotes == REQUIRED_VOTES_PER_QUESTIONS*g.Hub.GetNumberOfClientsConnected() {
-				// Remove this in production? Was needed during testing
-				// to let the clients catch up with the last message 'PlayersVotesToQuestionReceived'
-				time.Sleep(100 * time.Millisecond)
+	// If the sent playerVotes from client is valid
+	if err := isValidNumberOfVotes(m.Votes, settings.VotesPerQuestion); err != nil {
+		g.sendError(player, model.ERR_INVALID_VOTES, t, err.Error())
+		return
+	}
 
-				// Signal the players that this stage is done
-				g.Hub.BroadcastMsg(model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION_DONE})
-			}
-		}
-	case model.SELF_VOTE_ON_QUESTION:
-		var m model.SelfVoteOnQuestion
-		err := json.Unmarshal(d, &m)
-		if err != nil {
-			g.Hub.SendMsgToClient(fmt.Sprintf("unable to parse json-object '%s' to type '%s' ; error: %s", string(d), t, err.Error()), msg.Player)
-			return
-		}
-		// Check if the question number is valid
-		// question number must be between 1-4
-		if m.Question < 1 || m.Question > 4 {
-			g.Hub.SendMsgToClient(fmt.Sprintf("%d is a invalid question number, must be between 1-4", m.Question), msg.Player)
-			return
+	if !g.isParticipant(player) {
+		g.sendError(player, model.ERR_NOT_PARTICIPANT, t, "joined after the game started, wait for the next game")
+		return
+	}
+
+	// Only players in the game who are still in the hub can get votes
+	if invalid := invalidTargets(m.Votes, g.activeParticipants(), player, settings.AllowSelfVote); len(invalid) > 0 {
+		e := g.newError(model.ERR_INVALID_TARGETS, t, "can not vote on %s", strings.Join(invalid, ", "))
+		e.InvalidTargets = invalid
+		g.Hub.SendMsgToClient(e, player)
+		return
+	}
+
+	// Add playerVotes to game struct for this round
+	g.ag.mutex.Lock()
+	// Question slice starts at index 0
+	r := &g.ag.rounds[m.Question-1]
+	previous, voted := r.ballots[player]
+	if voted && !change {
+		g.ag.mutex.Unlock()
+		g.sendError(player, model.ERR_ALREADY_VOTED, t, "already voted on question %d, send '%s' to change the votes", m.Question, model.CHANGE_VOTE)
+		return
+	}
+	if !voted && change {
+		g.ag.mutex.Unlock()
+		g.sendError(player, model.ERR_NOT_VOTED, t, "has not voted on question %d yet", m.Question)
+		return
+	}
+	// Take back the votes that are replaced
+	for p, votes := range previous {
+		r.playerVotes[p] -= votes
+		if r.playerVotes[p] == 0 {
+			delete(r.playerVotes, p)
 		}
+	}
+	for p, votes := range m.Votes {
+		r.playerVotes[p] += votes
+	}
+	r.ballots[player] = m.Votes
+	g.ag.mutex.Unlock()
+
+	// Broadcast that a vote was received
+	g.Hub.BroadcastMsg(model.PlayersVotesToQuestionReceived{
+		PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION_RECIEVED},
+		Question:    m.Question,
+		Player:      player,
+		Changed:     change,
+	})
+	g.broadcastProgress()
+
+	// If everyone has voted on every question
+	if g.allVoted() {
+		g.closeVoting()
+	}
+}
 
-		// Check if the Decision is a valid type
-		if !(m.Decision == model.MOST_VOTES || m.Decision == model.NEUTRAL || m.Decision == model.LEAST_VOTES) {
-			g.Hub.SendMsgToClient(fmt.Sprintf("%s is a invalid decision, must be 'mostVotes','neutral' or 'leastVotes'", m.Decision), msg.Player)
-			return
+// allVoted checks if every participant still in the hub has voted on every
+// question. Votes from players who left are still counted
+func (g *Game) allVoted() bool {
+	players := g.activeParticipants()
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	for _, r := range g.ag.rounds {
+		for _, p := range players {
+			if _, ok := r.ballots[p]; !ok {
+				return false
+			}
 		}
+	}
+	return true
+}
 
-		// Register the self vote
-		g.ag.mutex.Lock()
-		g.ag.rounds[m.Question-1].selfVotes[msg.Player] = m.Decision
-		g.ag.mutex.Unlock()
+// closeVoting moves the game on to the self votes
+func (g *Game) closeVoting() {
+	g.setPhase(SelfVoting)
 
-		// Respond to clients that a vote was registered
-		g.Hub.BroadcastMsg(model.SelfVoteOnQuestionReceived{
-			PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION_RECEIVED},
-			Question:    m.Question,
-			Player:      msg.Player,
-		})
+	// Signal the players that this stage is done
+	g.Hub.BroadcastMsg(model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION_DONE})
+	g.broadcastProgress()
+}
 
-		// If all the players have self-voted for this round
-		if len(g.ag.rounds[m.Question-1].selfVotes) == g.Hub.GetNumberOfClientsConnected() {
-			// Calculate points the different points
-			responseMsg := model.SelfVoteOnQuestionDone{
-				PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION_DONE},
-				Question:    m.Question,
-				Points:      make(map[string]int),
-			}
-			// Get the current round
-			r := g.ag.rounds[m.Question-1]
-
-			// Find largest and smallest value
-			max, min := maxAndMinVotes(r.playerVotes)
-
-			// Give points to the players
-			for p, decision := range r.selfVotes {
-				v := r.playerVotes[p]
-				// Most votes and self-vote is mostVotes
-				if v == max && decision == model.MOST_VOTES {
-					responseMsg.Points[p] = model.POINTS_MAX
-
-					// Least Votes and self-vote is leastVotes
-				} else if v == min && decision == model.LEAST_VOTES {
-					responseMsg.Points[p] = model.POINTS_MAX
-
-					// between max and min + self-vote is neutral
-				} else if max > v && v > min && decision == model.NEUTRAL {
-					responseMsg.Points[p] = model.POINTS_NEUTRAL
-
-					// player missed on the self-vote
-				} else {
-					responseMsg.Points[p] = model.POINTS_ZERO
-				}
-			}
+func (g *Game) handleSelfVote(player string, m model.SelfVoteOnQuestion) {
+	// Check if the question number is valid
+	// question number must be between 1 and the number of questions
+	settings := g.settings()
+	if m.Question < 1 || m.Question > settings.NumberOfQuestions {
+		g.sendError(player, model.ERR_INVALID_QUESTION, model.SELF_VOTE_ON_QUESTION, "%d is a invalid question number, must be between 1-%d", m.Question, settings.NumberOfQuestions)
+		return
+	}
+
+	// Check if the Decision is a valid type
+	if !(m.Decision == model.MOST_VOTES || m.Decision == model.NEUTRAL || m.Decision == model.LEAST_VOTES) {
+		g.sendError(player, model.ERR_INVALID_DECISION, model.SELF_VOTE_ON_QUESTION, "%s is a invalid decision, must be 'mostVotes','neutral' or 'leastVotes'", m.Decision)
+		return
+	}
+
+	if !g.isParticipant(player) {
+		g.sendError(player, model.ERR_NOT_PARTICIPANT, model.SELF_VOTE_ON_QUESTION, "joined after the game started, wait for the next game")
+		return
+	}
+
+	// Register the self vote, unless the question is already scored
+	g.ag.mutex.Lock()
+	r := &g.ag.rounds[m.Question-1]
+	if r.done {
+		g.ag.mutex.Unlock()
+		g.sendError(player, model.ERR_INVALID_QUESTION, model.SELF_VOTE_ON_QUESTION, "question %d is already scored", m.Question)
+		return
+	}
+	r.selfVotes[player] = m.Decision
+	g.ag.mutex.Unlock()
+
+	// Respond to clients that a vote was registered
+	g.Hub.BroadcastMsg(model.SelfVoteOnQuestionReceived{
+		PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION_RECEIVED},
+		Question:    m.Question,
+		Player:      player,
+	})
+	g.broadcastProgress()
+
+	// If all the players have self-voted for this round
+	if g.allSelfVoted(m.Question) {
+		g.scoreQuestion(m.Question, nil)
+
+		// Every question is scored
+		if g.allRoundsDone() {
+			g.finishGame()
+		}
+	}
+}
 
-			// TODO: REMOVE IF EVERYTHING WORKS DURING PROD
-			time.Sleep(100 * time.Millisecond)
-			g.Hub.BroadcastMsg(responseMsg)
+// allSelfVoted checks if every participant still in the hub has self-voted
+// on the question. Players who left are only scored if they self-voted
+func (g *Game) allSelfVoted(question int) bool {
+	players := g.activeParticipants()
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	r := g.ag.rounds[question-1]
+	for _, p := range players {
+		if _, ok := r.selfVotes[p]; !ok {
+			return false
 		}
+	}
+	return true
+}
 
-	case model.PLAYERS_CONNECTED:
-		g.Hub.SendMsgToClient(model.PlayersConnected{PayloadType: model.PayloadType{Type: model.PLAYERS_CONNECTED}, NumberConnected: g.Hub.GetNumberOfClientsConnected()}, msg.Player)
-	default:
-		g.Hub.SendMsgToClient(fmt.Sprintf("'%s' is not of a valid message type", t), msg.Player)
+// scoreQuestion gives points for the self votes on the question and
+// broadcasts them. The players in missed did not self-vote in time and
+// get zero points
+func (g *Game) scoreQuestion(question int, missed []string) {
+	settings := g.settings()
+	g.ag.mutex.Lock()
+	r := &g.ag.rounds[question-1]
+	r.points = scoreRound(r, g.ag.participants, settings.Points)
+	for _, p := range missed {
+		r.points[p] = settings.Points.Zero
+	}
+	for p, points := range r.points {
+		g.ag.scores[p] += points
 	}
+	r.done = true
+	responseMsg := model.SelfVoteOnQuestionDone{
+		PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION_DONE},
+		Question:    question,
+		Points:      copyScores(r.points),
+		Totals:      copyScores(g.ag.scores),
+	}
+	g.ag.mutex.Unlock()
+	g.Hub.BroadcastMsg(responseMsg)
+	g.broadcastReveal(question)
+	g.broadcastScoreboard(false)
+}
+
+// finishGame moves the game to the results and broadcasts the final standings
+func (g *Game) finishGame() {
+	g.setPhase(Results)
+	g.Hub.BroadcastMsg(g.gameFinished())
+	g.broadcastScoreboard(true)
+}
 
+// allRoundsDone checks if every question in the game is scored
+func (g *Game) allRoundsDone() bool {
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	for _, r := range g.ag.rounds {
+		if !r.done {
+			return false
+		}
+	}
+	return true
 }
 
 // maxAndMinVotes find the max and min number of votes in the map
@@ -271,58 +469,111 @@ func maxAndMinVotes(votes map[string]int) (max, min int) {
 	return max, min
 }
 
-// beginRound starts the round/game by sending the players four questions
+// beginRound starts the round/game by sending the players the questions.
+// Questions already played in this hub are never picked again
 func (g *Game) beginGame() {
-	q, err := g.Database.GetQuestions()
+	g.ag.mutex.RLock()
+	played := append([]int64(nil), g.ag.questions...)
+	g.ag.mutex.RUnlock()
+
+	s := g.Hub.Settings()
+	q, err := g.Database.SelectQuestions(database.QuestionFilter{
+		Language: s.Language,
+		Category: s.Category,
+		Packs:    s.Packs,
+		Exclude:  played,
+		Limit:    s.Game.NumberOfQuestions,
+	})
+	if err == database.ErrNotEnoughQuestions {
+		g.setPhase(Finished)
+		g.Hub.BroadcastMsg(model.NoMoreQuestions{
+			PayloadType:     model.PayloadType{Type: model.NO_MORE_QUESTIONS},
+			QuestionsPlayed: len(played),
+			Message:         fmt.Sprintf("there are not enough new questions left in this hub, %d questions have already been played", len(played)),
+		})
+		return
+	}
 	if err != nil {
-		// TODO: broadcast error message
-		// Implement a error
-		//g.Hub.BroadcastMsg()
+		log.Printf("unable to get questions for hub '%s' - %s\n", g.Hub.HubID(), err.Error())
+		g.Hub.BroadcastMsg(model.Error{
+			PayloadType: model.PayloadType{Type: model.ERROR},
+			Code:        model.ERR_INTERNAL,
+			Message:     "unable to get questions",
+			Phase:       string(g.Phase()),
+		})
 		return
 	}
 
-	// Init the game for four rounds
-	for i := 0; i < model.MAX_NUMBER_OF_ROUND; i++ {
+	// Init one round per question
+	texts := make([]string, len(q))
+	g.ag.mutex.Lock()
+	g.ag.participants = g.Hub.Players()
+	g.ag.rounds = make([]round, 0, s.Game.NumberOfQuestions)
+	for i := 0; i < s.Game.NumberOfQuestions; i++ {
+		texts[i] = q[i].Text
 		g.ag.rounds = append(g.ag.rounds, round{
+			question:    q[i].Text,
 			playerVotes: make(map[string]int),
+			ballots:     make(map[string]map[string]int),
 			selfVotes:   make(map[string]string),
 		})
 	}
 
-	// TODO: Check that the questions have not already been sent in this hub
-	// Recall this function if true
-
-	// Append the questions to the slice of questions
-	g.ag.questions = append(g.ag.questions, q...)
+	// Remember the questions, so the next games in the hub get new ones
+	for _, picked := range q {
+		g.ag.questions = append(g.ag.questions, picked.ID)
+	}
+	g.ag.mutex.Unlock()
 
-	// TODO: Remove this if nessecary. Used it to let the clients proccess the previous
-	// message after reciving this
-	time.Sleep(200 * time.Millisecond)
+	g.setPhase(Voting)
 
 	// Send question to players
-	g.Hub.BroadcastMsg(model.Questions{PayloadType: model.PayloadType{Type: model.FOUR_QUESTIONS}, Question: q})
+	g.Hub.BroadcastMsg(model.Questions{PayloadType: model.PayloadType{Type: model.FOUR_QUESTIONS}, Question: texts})
+	g.broadcastProgress()
 }
 
 // isValidNumberOfVotes validates that the sent playerVotes from a client is valid
-func isValidNumberOfVotes(v map[string]int) error {
+func isValidNumberOfVotes(v map[string]int, votesPerQuestion int) error {
 	var totalVotes int
 
 	for _, num := range v {
-		// min playerVotes is 1 and max is 2
+		// min playerVotes is 1 and max is votesPerQuestion
 		// Checks for negative numbers
-		if !(num == 1 || num == 2) {
-			return fmt.Errorf("vote on player per client is 1 or 2, not %d", num)
+		if num < 1 || num > votesPerQuestion {
+			return fmt.Errorf("vote on player per client is between 1-%d, not %d", votesPerQuestion, num)
 		}
 		totalVotes += num
 	}
-	// players must vote 2 times
-	if totalVotes != 2 {
-		return fmt.Errorf("players must use 2 playerVotes, not %d", totalVotes)
+	// players must use all their votes
+	if totalVotes != votesPerQuestion {
+		return fmt.Errorf("players must use %d playerVotes, not %d", votesPerQuestion, totalVotes)
 	}
 
 	return nil
 }
 
+// invalidTargets returns the sorted names in the votes that are not players
+// in the hub, and the voter if self votes are not allowed
+func invalidTargets(v map[string]int, players []string, voter string, allowSelfVote bool) []string {
+	inHub := make(map[string]bool, len(players))
+	for _, p := range players {
+		inHub[p] = true
+	}
+	var invalid []string
+	for p := range v {
+		if !inHub[p] || (p == voter && !allowSelfVote) {
+			invalid = append(invalid, p)
+		}
+	}
+	sort.Strings(invalid)
+	return invalid
+}
+
+// settings returns the game settings chosen when the hub was created
+func (g *Game) settings() model.GameSettings {
+	return g.Hub.Settings().Game
+}
+
 // find what type of payload and the index the actual payload starts at
 func getPayloadType(data []byte) (string, int, error) {
 	var t string
@@ -347,8 +598,12 @@ func getPayloadType(data []byte) (string, int, error) {
 		}
 		t += string(d)
 	}
-	// this return should never happen
-	return "", 0, fmt.Errorf("unable to parse the data")
+	// No comma, the message only has the payloadtype, e.g. '{"payloadtype":"PlayersConnected"}'
+	err := json.Unmarshal(data, &p)
+	if err != nil || p.Type == "" {
+		return "", 0, fmt.Errorf("unable to parse the data")
+	}
+	return p.Type, len(data) - 1, nil
 }
 
 // getPayload filters out the payloadtype from the data
@@ -0,0 +1,75 @@
+package game
+
+import (
+	"github.com/selvinnsikt/backend/model"
+)
+
+// handleHostMessage checks that the message is sent by the host before
+// dispatching it. The host can kick players, lock the lobby, start the game
+// and pass the host role on
+func (g *Game) handleHostMessage(player, t string, d []byte) {
+	if g.Hub.Host() != player {
+		g.sendError(player, model.ERR_NOT_HOST, t, "only the host '%s' can send '%s'", g.Hub.Host(), t)
+		return
+	}
+
+	switch t {
+	case model.KICK_PLAYER:
+		var m model.KickPlayer
+		if !g.parsePayload(player, t, d, &m) {
+			return
+		}
+		g.handleKickPlayer(player, m)
+	case model.LOCK_LOBBY:
+		var m model.LockLobby
+		if !g.parsePayload(player, t, d, &m) {
+			return
+		}
+		g.Hub.SetLocked(m.Locked)
+		g.broadcastRoster()
+	case model.START_GAME:
+		g.handleStartGame(player)
+	case model.TRANSFER_HOST:
+		var m model.TransferHost
+		if !g.parsePayload(player, t, d, &m) {
+			return
+		}
+		if m.Player == player {
+			g.sendError(player, model.ERR_INVALID_PLAYER, t, "'%s' is already the host", player)
+			return
+		}
+		if err := g.Hub.SetHost(m.Player); err != nil {
+			g.sendError(player, model.ERR_INVALID_PLAYER, t, "%s", err.Error())
+			return
+		}
+		g.broadcastRoster()
+	}
+}
+
+// handleKickPlayer removes the player from the hub. The game goes on as if
+// the player left
+func (g *Game) handleKickPlayer(host string, m model.KickPlayer) {
+	if m.Player == host {
+		g.sendError(host, model.ERR_INVALID_PLAYER, model.KICK_PLAYER, "the host can not kick themselves")
+		return
+	}
+	online, err := g.Hub.Kick(m.Player, "kicked by the host '"+host+"'")
+	if err != nil {
+		g.sendError(host, model.ERR_INVALID_PLAYER, model.KICK_PLAYER, "%s", err.Error())
+		return
+	}
+	// Nobody reads from the connection of a player who lost it
+	if !online {
+		g.handleHubEvent(model.Message{Player: m.Player, Event: model.PLAYER_LEFT})
+	}
+}
+
+// handleStartGame starts the game without waiting for everyone to be ready
+func (g *Game) handleStartGame(host string) {
+	players := g.Hub.Players()
+	if min := g.settings().MinPlayers; len(players) < min {
+		g.sendError(host, model.ERR_NOT_ENOUGH_PLAYERS, model.START_GAME, "at least %d players are needed, there are %d", min, len(players))
+		return
+	}
+	g.beginGame()
+}
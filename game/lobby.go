@@ -0,0 +1,200 @@
+package game
+
+import (
+	"github.com/selvinnsikt/backend/model"
+)
+
+// handleHubEvent keeps the ready state in sync with the players connected to
+// the hub, and tells everyone when players and viewers come and go
+func (g *Game) handleHubEvent(msg model.Message) {
+	switch msg.Event {
+	case model.PLAYER_JOINED:
+		g.ag.mutex.Lock()
+		g.ready[msg.Player] = false
+		g.ag.mutex.Unlock()
+		g.broadcastRoster()
+	case model.PLAYER_DISCONNECTED:
+		// The player keeps the place in the game and can rejoin
+		g.broadcastRoster()
+	case model.PLAYER_RECONNECTED:
+		g.Hub.SendMsgToClient(g.state(msg.Player, false), msg.Player)
+		g.broadcastRoster()
+	case model.VIEWER_JOINED:
+		// Spectators and displays can attach mid-game and need to catch up
+		g.Hub.SendMsgToViewer(g.state(msg.Player, true), msg.Player)
+		g.broadcastRoster()
+	case model.VIEWER_LEFT:
+		g.broadcastRoster()
+	case model.PLAYER_LEFT:
+		// The name is already taken by a new connection
+		if g.Hub.IsConnected(msg.Player) {
+			return
+		}
+		g.ag.mutex.Lock()
+		delete(g.ready, msg.Player)
+		g.ag.mutex.Unlock()
+		g.Hub.BroadcastMsg(model.PlayerLeft{
+			PayloadType:  model.PayloadType{Type: model.PLAYER_LEFT},
+			Player:       msg.Player,
+			Phase:        string(g.Phase()),
+			Participants: g.activeParticipants(),
+		})
+		g.broadcastRoster()
+		g.broadcastProgress()
+		g.playerLeft()
+	}
+}
+
+// playerLeft closes the phase if the player who left was the last one the
+// game waited for
+func (g *Game) playerLeft() {
+	switch g.Phase() {
+	case Lobby:
+		// The player who left might have been the only one not ready
+		if g.allPlayersReady() {
+			g.beginGame()
+		}
+	case Voting:
+		// The players left might have nobody they can vote on
+		if g.allVoted() || g.tooFewToVote() {
+			g.closeVoting()
+		}
+	case SelfVoting:
+		g.ag.mutex.RLock()
+		var unscored []int
+		for i, r := range g.ag.rounds {
+			if !r.done {
+				unscored = append(unscored, i+1)
+			}
+		}
+		g.ag.mutex.RUnlock()
+		for _, q := range unscored {
+			if g.allSelfVoted(q) {
+				g.scoreQuestion(q, nil)
+			}
+		}
+		if len(unscored) > 0 && g.allRoundsDone() {
+			g.finishGame()
+		}
+	}
+}
+
+// tooFewToVote checks if the participants still in the hub are too few to
+// give valid votes, e.g. a single player when self votes are off
+func (g *Game) tooFewToVote() bool {
+	min := 1
+	if !g.settings().AllowSelfVote {
+		min = 2
+	}
+	return len(g.activeParticipants()) < min
+}
+
+// activeParticipants returns the players in the game who are still in the hub.
+// Every connected player takes part while the game is in the lobby
+func (g *Game) activeParticipants() []string {
+	players := g.Hub.Players()
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	if g.phase == Lobby {
+		return players
+	}
+	connected := make(map[string]bool, len(players))
+	for _, p := range players {
+		connected[p] = true
+	}
+	active := []string{}
+	for _, p := range g.ag.participants {
+		if connected[p] {
+			active = append(active, p)
+		}
+	}
+	return active
+}
+
+// isParticipant checks if the player was in the hub when the game started
+func (g *Game) isParticipant(player string) bool {
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	for _, p := range g.ag.participants {
+		if p == player {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Game) handleReadyToPlay(player string, m model.ReadyToPlay) {
+	// Add type to the message
+	m.Type = model.READY_TO_PLAY
+
+	// Add playername to the message
+	m.Player = player
+
+	// If player sent ready or not ready. Sending the same state twice
+	// changes nothing
+	g.ag.mutex.Lock()
+	g.ready[player] = m.Ready
+	g.ag.mutex.Unlock()
+
+	// Broadcast to other players that the player is ready or not ready
+	g.Hub.BroadcastMsg(m)
+	g.broadcastRoster()
+
+	// If everyone is ready
+	if g.allPlayersReady() {
+		// Starting the game
+		g.beginGame()
+	}
+}
+
+// NumberPlayersReady returns how many of the connected players are ready
+func (g *Game) NumberPlayersReady() int {
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	var n int
+	for _, p := range g.Hub.Players() {
+		if g.ready[p] {
+			n++
+		}
+	}
+	return n
+}
+
+// allPlayersReady checks if there are enough players and every one of them is ready
+func (g *Game) allPlayersReady() bool {
+	players := g.Hub.Players()
+	return len(players) >= g.settings().MinPlayers && g.NumberPlayersReady() == len(players)
+}
+
+// broadcastRoster sends every player's ready state and who the host is
+func (g *Game) broadcastRoster() {
+	g.Hub.BroadcastMsg(g.roster())
+}
+
+// roster returns every player's ready state and who the host is
+func (g *Game) roster() model.LobbyRoster {
+	host := g.Hub.Host()
+	roster := model.LobbyRoster{
+		PayloadType: model.PayloadType{Type: model.LOBBY_ROSTER},
+		Players:     []model.RosterPlayer{},
+		Host:        host,
+		Locked:      g.Hub.Locked(),
+		Spectators:  g.Hub.NumberOfViewers(model.ROLE_SPECTATOR),
+		Displays:    g.Hub.NumberOfViewers(model.ROLE_DISPLAY),
+	}
+	g.ag.mutex.RLock()
+	for _, p := range g.Hub.Players() {
+		roster.Players = append(roster.Players, model.RosterPlayer{
+			Name:      p,
+			Ready:     g.ready[p],
+			Host:      p == host,
+			Connected: g.Hub.IsOnline(p),
+			LatencyMs: g.Hub.Latency(p).Milliseconds(),
+		})
+		if g.ready[p] {
+			roster.NumberReady++
+		}
+	}
+	g.ag.mutex.RUnlock()
+	return roster
+}
@@ -0,0 +1,84 @@
+package game
+
+import (
+	"github.com/selvinnsikt/backend/model"
+	"log"
+)
+
+// Phase is the stage a game is in. Every message type from the clients is
+// only accepted in the phases listed in messagePhases
+type Phase string
+
+const (
+	// Waiting for every player to be ready
+	Lobby Phase = "Lobby"
+	// Players vote on who fits the questions
+	Voting Phase = "Voting"
+	// Players guess how many votes they got on each question
+	SelfVoting Phase = "SelfVoting"
+	// Every question is scored
+	Results Phase = "Results"
+	// The game can not continue, e.g. no more questions or the hub is closed
+	Finished Phase = "Finished"
+)
+
+// transitions lists the phases a game can move to from each phase
+var transitions = map[Phase][]Phase{
+	Lobby:      {Voting, Finished},
+	Voting:     {SelfVoting, Finished},
+	SelfVoting: {Results, Finished},
+	Results:    {Lobby, Finished},
+	Finished:   {},
+}
+
+// messagePhases lists the phases each message type is accepted in.
+// Message types not listed are accepted in every phase
+var messagePhases = map[string][]Phase{
+	model.READY_TO_PLAY:            {Lobby},
+	model.PLAYERS_VOTE_TO_QUESTION: {Voting},
+	model.CHANGE_VOTE:              {Voting},
+	model.SELF_VOTE_ON_QUESTION:    {SelfVoting},
+	model.PLAY_AGAIN:               {Results},
+	model.START_GAME:               {Lobby},
+}
+
+// Phase returns the current phase of the game
+func (g *Game) Phase() Phase {
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	return g.phase
+}
+
+// setPhase moves the game to the next phase if the transition is allowed
+func (g *Game) setPhase(next Phase) bool {
+	g.ag.mutex.Lock()
+	defer g.ag.mutex.Unlock()
+	if g.phase == next {
+		return true
+	}
+	for _, p := range transitions[g.phase] {
+		if p == next {
+			log.Printf("hub '%s' moved from phase '%s' to '%s'\n", g.Hub.HubID(), g.phase, next)
+			g.phase = next
+			g.startTimer(next)
+			return true
+		}
+	}
+	log.Printf("ERROR - hub '%s' can not move from phase '%s' to '%s'\n", g.Hub.HubID(), g.phase, next)
+	return false
+}
+
+// acceptedInPhase checks if the message type is allowed in the current phase
+func (g *Game) acceptedInPhase(payloadType string) bool {
+	phases, ok := messagePhases[payloadType]
+	if !ok {
+		return true
+	}
+	current := g.Phase()
+	for _, p := range phases {
+		if p == current {
+			return true
+		}
+	}
+	return false
+}
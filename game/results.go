@@ -0,0 +1,160 @@
+package game
+
+import (
+	"github.com/selvinnsikt/backend/model"
+	"log"
+	"sort"
+)
+
+// scoreRound gives points to every player who self-voted on the round.
+// Participants nobody voted on count as having zero votes
+func scoreRound(r *round, participants []string, points model.PointsTable) map[string]int {
+	scored := make(map[string]int)
+
+	votes := make(map[string]int, len(participants))
+	for _, p := range participants {
+		votes[p] = 0
+	}
+	for p, v := range r.playerVotes {
+		votes[p] = v
+	}
+
+	// Find largest and smallest value
+	max, min := maxAndMinVotes(votes)
+
+	for p, decision := range r.selfVotes {
+		v := votes[p]
+		// Most votes and self-vote is mostVotes
+		if v == max && decision == model.MOST_VOTES {
+			scored[p] = points.Max
+
+			// Least Votes and self-vote is leastVotes
+		} else if v == min && decision == model.LEAST_VOTES {
+			scored[p] = points.Max
+
+			// between max and min + self-vote is neutral
+		} else if max > v && v > min && decision == model.NEUTRAL {
+			scored[p] = points.Neutral
+
+			// player missed on the self-vote
+		} else {
+			scored[p] = points.Zero
+		}
+	}
+	return scored
+}
+
+// Scores returns a copy of the running score of every player in the game
+func (g *Game) Scores() map[string]int {
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	return copyScores(g.ag.scores)
+}
+
+// gameFinished builds the final results from the scored rounds
+func (g *Game) gameFinished() model.GameFinished {
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+
+	m := model.GameFinished{
+		PayloadType: model.PayloadType{Type: model.GAME_FINISHED},
+		Game:        len(g.history) + 1,
+		Standings:   standings(g.ag.scores),
+		Winners:     []string{},
+		Questions:   make([]model.QuestionResult, len(g.ag.rounds)),
+	}
+	for _, s := range m.Standings {
+		if s.Rank == 1 {
+			m.Winners = append(m.Winners, s.Player)
+		}
+	}
+	m.Tie = len(m.Winners) > 1
+
+	for i, r := range g.ag.rounds {
+		q := model.QuestionResult{
+			Question:  i + 1,
+			Text:      r.question,
+			Votes:     make(map[string]int),
+			Decisions: make(map[string]string),
+			Points:    copyScores(r.points),
+		}
+		for p, v := range r.playerVotes {
+			q.Votes[p] = v
+		}
+		for p, d := range r.selfVotes {
+			q.Decisions[p] = d
+		}
+		m.Questions[i] = q
+	}
+	return m
+}
+
+// standings sorts the players by points. Players with the same points share
+// the rank, and the next rank is skipped, e.g. 1, 1, 3
+func standings(scores map[string]int) []model.Standing {
+	s := make([]model.Standing, 0, len(scores))
+	for p, points := range scores {
+		s = append(s, model.Standing{Player: p, Points: points})
+	}
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Points != s[j].Points {
+			return s[i].Points > s[j].Points
+		}
+		return s[i].Player < s[j].Player
+	})
+	for i := range s {
+		if i > 0 && s[i].Points == s[i-1].Points {
+			s[i].Rank = s[i-1].Rank
+		} else {
+			s[i].Rank = i + 1
+		}
+	}
+	return s
+}
+
+func copyScores(scores map[string]int) map[string]int {
+	c := make(map[string]int, len(scores))
+	for p, points := range scores {
+		c[p] = points
+	}
+	return c
+}
+
+// handlePlayAgain archives the results of the game and moves back to the
+// lobby, where the players must ready up again. The questions already played
+// are kept so the next game gets new ones
+func (g *Game) handlePlayAgain(player string) {
+	finished := g.gameFinished()
+
+	g.ag.mutex.Lock()
+	g.history = append(g.history, model.GameResult{
+		Game:      finished.Game,
+		Standings: finished.Standings,
+		Winners:   finished.Winners,
+	})
+	g.ag.rounds = nil
+	g.ag.scores = make(map[string]int)
+	for p := range g.ready {
+		g.ready[p] = false
+	}
+	m := model.PlayAgain{
+		PayloadType: model.PayloadType{Type: model.PLAY_AGAIN},
+		Player:      player,
+		Game:        len(g.history) + 1,
+		History:     append([]model.GameResult(nil), g.history...),
+	}
+	g.ag.mutex.Unlock()
+
+	g.setPhase(Lobby)
+	log.Printf("player '%s' started game %d in hub '%s'\n", player, m.Game, g.Hub.HubID())
+
+	g.Hub.BroadcastMsg(m)
+	g.broadcastRoster()
+}
+
+// History returns the results of the earlier games in the hub
+func (g *Game) History() []model.GameResult {
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	return append([]model.GameResult(nil), g.history...)
+}
@@ -0,0 +1,55 @@
+package game
+
+import (
+	"github.com/selvinnsikt/backend/model"
+)
+
+// state is a snapshot of the game for a player who rejoins the hub, or a
+// spectator or display that attaches to it. Viewers do not get the votes
+// and self-votes of any player
+func (g *Game) state(player string, viewer bool) model.GameState {
+	roster := g.roster()
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+
+	s := model.GameState{
+		PayloadType: model.PayloadType{Type: model.GAME_STATE},
+		Player:      player,
+		Phase:       string(g.phase),
+		Settings:    g.Hub.Settings(),
+		Game:        len(g.history) + 1,
+		Roster:      roster,
+		Questions:   []model.QuestionState{},
+		Totals:      copyScores(g.ag.scores),
+		History:     append([]model.GameResult{}, g.history...),
+	}
+	for i, r := range g.ag.rounds {
+		q := model.QuestionState{
+			Question:  i + 1,
+			Text:      r.question,
+			Voted:     []string{},
+			SelfVoted: []string{},
+		}
+		if !viewer {
+			q.Votes = r.ballots[player]
+			q.Decision = r.selfVotes[player]
+		}
+		for _, p := range g.ag.participants {
+			if _, ok := r.ballots[p]; ok {
+				q.Voted = append(q.Voted, p)
+			}
+			if _, ok := r.selfVotes[p]; ok {
+				q.SelfVoted = append(q.SelfVoted, p)
+			}
+		}
+		if r.done {
+			q.Points = copyScores(r.points)
+		}
+		s.Questions = append(s.Questions, q)
+	}
+	if g.timer != nil {
+		t := g.timer.payload()
+		s.Timer = &t
+	}
+	return s
+}
@@ -0,0 +1,165 @@
+package game
+
+import (
+	"github.com/selvinnsikt/backend/model"
+	"log"
+	"time"
+)
+
+// timerTick is how often the time left of a phase is broadcasted
+var timerTick = time.Second
+
+// phaseTimer is the deadline of one phase. It is stopped when the game
+// leaves the phase before the deadline
+type phaseTimer struct {
+	phase    Phase
+	deadline time.Time
+	stop     chan struct{}
+}
+
+// startTimer stops the timer of the previous phase and starts the timer of the
+// next phase if it has a deadline. Must be called with ag.mutex locked
+func (g *Game) startTimer(p Phase) {
+	if g.timer != nil {
+		close(g.timer.stop)
+		g.timer = nil
+	}
+	var seconds int
+	switch p {
+	case Voting:
+		seconds = g.settings().VotingSeconds
+	case SelfVoting:
+		seconds = g.settings().SelfVotingSeconds
+	}
+	// The phase has no deadline
+	if seconds == 0 {
+		return
+	}
+	g.timer = &phaseTimer{
+		phase:    p,
+		deadline: time.Now().Add(time.Duration(seconds) * time.Second),
+		stop:     make(chan struct{}),
+	}
+	go g.runTimer(g.timer)
+}
+
+// runTimer broadcasts the time left every tick, and passes the timer on to
+// readHubMessages when the deadline runs out
+func (g *Game) runTimer(t *phaseTimer) {
+	ticker := time.NewTicker(timerTick)
+	defer ticker.Stop()
+	g.broadcastTimer(t)
+	for {
+		select {
+		case <-ticker.C:
+			if time.Now().Before(t.deadline) {
+				g.broadcastTimer(t)
+				continue
+			}
+			select {
+			case g.timeoutChan <- t:
+			case <-t.stop:
+			case <-g.Hub.Done():
+			}
+			return
+		case <-t.stop:
+			return
+		case <-g.Hub.Done():
+			return
+		}
+	}
+}
+
+func (g *Game) broadcastTimer(t *phaseTimer) {
+	g.Hub.BroadcastMsg(t.payload())
+}
+
+// payload returns the time left of the phase
+func (t *phaseTimer) payload() model.PhaseTimer {
+	left := time.Until(t.deadline).Round(time.Second)
+	if left < 0 {
+		left = 0
+	}
+	return model.PhaseTimer{
+		PayloadType: model.PayloadType{Type: model.PHASE_TIMER},
+		Phase:       string(t.phase),
+		SecondsLeft: int(left / time.Second),
+		Deadline:    t.deadline.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// handleTimeout closes the phase when its deadline runs out. Votes that are
+// missing are not counted, and missing self votes give zero points
+func (g *Game) handleTimeout(t *phaseTimer) {
+	g.ag.mutex.RLock()
+	current := g.timer == t && g.phase == t.phase
+	g.ag.mutex.RUnlock()
+	// The phase was closed while the timeout was on its way
+	if !current {
+		return
+	}
+
+	missing := g.missingPlayers(t.phase)
+	log.Printf("time is up for phase '%s' in hub '%s', missing players: %v\n", t.phase, g.Hub.HubID(), missing)
+	m := model.TimeUp{
+		PayloadType: model.PayloadType{Type: model.TIME_UP},
+		Phase:       string(t.phase),
+		Missing:     missing,
+	}
+
+	switch t.phase {
+	case Voting:
+		m.Message = "time is up, missing votes are not counted"
+		g.Hub.BroadcastMsg(m)
+		g.closeVoting()
+	case SelfVoting:
+		m.Message = "time is up, missing self votes give zero points"
+		g.Hub.BroadcastMsg(m)
+		players := g.activeParticipants()
+		g.ag.mutex.RLock()
+		var unscored []int
+		missed := make(map[int][]string)
+		for i, r := range g.ag.rounds {
+			if r.done {
+				continue
+			}
+			unscored = append(unscored, i+1)
+			for _, p := range players {
+				if _, ok := r.selfVotes[p]; !ok {
+					missed[i+1] = append(missed[i+1], p)
+				}
+			}
+		}
+		g.ag.mutex.RUnlock()
+		for _, q := range unscored {
+			g.scoreQuestion(q, missed[q])
+		}
+		g.finishGame()
+	}
+}
+
+// missingPlayers returns the participants still in the hub who have not
+// submitted on every question in the phase
+func (g *Game) missingPlayers(p Phase) []string {
+	missing := []string{}
+	players := g.activeParticipants()
+	g.ag.mutex.RLock()
+	defer g.ag.mutex.RUnlock()
+	for _, player := range players {
+		for _, r := range g.ag.rounds {
+			submitted := false
+			switch p {
+			case Voting:
+				_, submitted = r.ballots[player]
+			case SelfVoting:
+				_, submitted = r.selfVotes[player]
+				submitted = submitted || r.done
+			}
+			if !submitted {
+				missing = append(missing, player)
+				break
+			}
+		}
+	}
+	return missing
+}
@@ -5,4 +5,5 @@ go 1.14
 require (
 	github.com/gorilla/mux v1.7.4
 	github.com/gorilla/websocket v1.4.2
+	github.com/mattn/go-sqlite3 v1.14.16
 )
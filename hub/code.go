@@ -0,0 +1,158 @@
+package hub
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"strings"
+)
+
+// Styles of hub IDs
+const (
+	// e.g. '40912'
+	CodeDigits = "digits"
+	// e.g. 'KXRT', without letters that are easy to mix up
+	CodeLetters = "letters"
+	// e.g. 'brave-blue-otter', the length is the number of words
+	CodeWords = "words"
+)
+
+// Letters used in letter codes. I, L and O are left out since they look like 1 and 0
+const codeLetters = "ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// minCodes is the fewest hub IDs a code config can give, so that the random
+// IDs are quick to find and hard to guess
+const minCodes = 100000
+
+// Words used in word codes. Every word but the last is an adjective
+var (
+	codeAdjectives = []string{
+		"blue", "bold", "bouncy", "brave", "breezy", "bright", "bubbly", "busy",
+		"calm", "cheeky", "cheerful", "chilly", "chubby", "clever", "cool", "cosy",
+		"crazy", "curly", "cute", "daring", "dizzy", "dreamy", "dusty", "eager",
+		"fair", "fancy", "fast", "fierce", "fluffy", "frosty", "funny", "fuzzy",
+		"gentle", "giant", "glad", "golden", "green", "grumpy", "handy", "happy",
+		"hasty", "hungry", "icy", "jolly", "jumpy", "keen", "kind", "lazy",
+		"lively", "loud", "lucky", "merry", "mighty", "misty", "modest", "neat",
+		"nimble", "noisy", "odd", "orange", "pink", "plucky", "polite", "proud",
+		"purple", "quick", "quiet", "rapid", "red", "rosy", "rusty", "salty",
+		"sandy", "scary", "sharp", "shiny", "shy", "silly", "silver", "sleepy",
+		"smart", "snowy", "sparkly", "speedy", "spicy", "steady", "stormy",
+		"sturdy", "sunny", "sweet", "swift", "tidy", "tiny", "tough", "warm",
+		"wild", "wise", "witty", "young", "zesty",
+	}
+	codeNouns = []string{
+		"alpaca", "ant", "badger", "bat", "bear", "beaver", "bee", "bison",
+		"buffalo", "camel", "canary", "cat", "cheetah", "cobra", "cougar", "cow",
+		"coyote", "crab", "crane", "crow", "deer", "dingo", "dolphin", "donkey",
+		"dove", "dragon", "duck", "eagle", "eel", "elk", "emu", "falcon", "ferret",
+		"finch", "flamingo", "fox", "frog", "gecko", "giraffe", "goat", "goose",
+		"gorilla", "hamster", "hare", "hawk", "hedgehog", "heron", "hippo",
+		"horse", "hyena", "iguana", "jaguar", "kangaroo", "koala", "lemur",
+		"leopard", "lion", "llama", "lobster", "lynx", "magpie", "mole", "monkey",
+		"moose", "mouse", "narwhal", "octopus", "ostrich", "otter", "owl", "panda",
+		"parrot", "pelican", "penguin", "pig", "pony", "puffin", "rabbit", "raven",
+		"rhino", "robin", "salmon", "seal", "shark", "sheep", "sloth", "snail",
+		"spider", "squid", "stork", "swan", "tiger", "toad", "trout", "turtle",
+		"walrus", "weasel", "wolf", "yak", "zebra",
+	}
+)
+
+// CodeConfig decides what hub IDs look like
+type CodeConfig struct {
+	Style string
+	// Number of characters, or number of words for word codes
+	Length int
+}
+
+// DefaultCodeConfig returns five digit codes
+func DefaultCodeConfig() CodeConfig {
+	return CodeConfig{Style: CodeDigits, Length: defaultCodeLength[CodeDigits]}
+}
+
+// defaultCodeLength is used when the length is not set
+var defaultCodeLength = map[string]int{
+	CodeDigits:  5,
+	CodeLetters: 4,
+	CodeWords:   3,
+}
+
+// Validate checks the style, that the length is within limits and that there
+// are at least minCodes codes. A length of 0 is replaced with the default
+// length of the style
+func (c *CodeConfig) Validate() error {
+	if c.Length == 0 {
+		c.Length = defaultCodeLength[c.Style]
+	}
+	switch c.Style {
+	case CodeDigits, CodeLetters:
+		if c.Length < 3 || c.Length > 10 {
+			return fmt.Errorf("%s codes must have a length between 3-10, not %d", c.Style, c.Length)
+		}
+	case CodeWords:
+		if c.Length < 2 || c.Length > 4 {
+			return fmt.Errorf("word codes must have between 2-4 words, not %d", c.Length)
+		}
+	default:
+		return fmt.Errorf("'%s' is not a valid code style, must be '%s', '%s' or '%s'", c.Style, CodeDigits, CodeLetters, CodeWords)
+	}
+	if total := c.total(); total < minCodes {
+		return fmt.Errorf("%s codes of length %d only give %d hub IDs, at least %d are needed", c.Style, c.Length, total, minCodes)
+	}
+	return nil
+}
+
+// total returns how many different codes there are
+func (c CodeConfig) total() int64 {
+	base, n := int64(10), c.Length
+	switch c.Style {
+	case CodeLetters:
+		base = int64(len(codeLetters))
+	case CodeWords:
+		base, n = int64(len(codeAdjectives)), c.Length-1
+	}
+	total := int64(1)
+	for i := 0; i < n; i++ {
+		total *= base
+	}
+	if c.Style == CodeWords {
+		total *= int64(len(codeNouns))
+	}
+	return total
+}
+
+// generate creates a random code, it might already be in use
+func (c CodeConfig) generate() string {
+	switch c.Style {
+	case CodeLetters:
+		b := make([]byte, c.Length)
+		for i := range b {
+			b[i] = codeLetters[mathrand.Intn(len(codeLetters))]
+		}
+		return string(b)
+	case CodeWords:
+		words := make([]string, c.Length)
+		for i := 0; i < c.Length-1; i++ {
+			words[i] = codeAdjectives[mathrand.Intn(len(codeAdjectives))]
+		}
+		words[c.Length-1] = codeNouns[mathrand.Intn(len(codeNouns))]
+		return strings.Join(words, "-")
+	default:
+		b := make([]byte, c.Length)
+		for i := range b {
+			b[i] = byte('0' + mathrand.Intn(10))
+		}
+		return string(b)
+	}
+}
+
+// normalize lets players type letter and word codes in any case
+func (c CodeConfig) normalize(id string) string {
+	switch c.Style {
+	case CodeLetters:
+		return strings.ToUpper(id)
+	case CodeWords:
+		return strings.ToLower(id)
+	default:
+		return id
+	}
+}
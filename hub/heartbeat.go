@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/selvinnsikt/backend/model"
+	"strconv"
+	"time"
+)
+
+// heartbeat pings the connection every PingInterval. The connection must
+// answer with a pong within PongWait, or the read fails and the client is
+// treated as gone. The time sent in the ping gives the latency of the client.
+// Returns a function that stops the pings
+func (h *Hub) heartbeat(pc *model.PlayerConnection) func() {
+	c := h.registry.config
+	if c.PingInterval <= 0 {
+		return func() {}
+	}
+	conn := pc.Conn
+	conn.SetReadDeadline(time.Now().Add(c.PongWait))
+	conn.SetPongHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(c.PongWait))
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			h.setLatency(pc, time.Since(time.Unix(0, sent)))
+		}
+		return nil
+	})
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(c.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ping := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+				// The reader fails as well when the ping can not be sent
+				if err := conn.WriteControl(websocket.PingMessage, ping, time.Now().Add(writeWait)); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			case <-h.done:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// setLatency stores the round trip time of the last ping, if the connection
+// still belongs to the player
+func (h *Hub) setLatency(pc *model.PlayerConnection, d time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if c, ok := h.clientsConn[pc.Name]; ok && c.Conn == pc.Conn {
+		c.latency = d
+		h.clientsConn[pc.Name] = c
+		h.latencyChanged = true
+	}
+}
+
+// broadcastLatencies sends the latency of every player once per interval,
+// when a player has answered a ping since the last time. One message for the
+// whole hub keeps the pongs from filling the queues of the clients
+func (h *Hub) broadcastLatencies(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if m, changed := h.latencies(); changed {
+				h.BroadcastMsg(m)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// latencies returns the latency of every player in the hub, and false if
+// nobody has answered a ping since the last call
+func (h *Hub) latencies() (model.Latency, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.latencyChanged {
+		return model.Latency{}, false
+	}
+	h.latencyChanged = false
+	m := model.Latency{
+		PayloadType: model.PayloadType{Type: model.LATENCY},
+		LatencyMs:   make(map[string]int64, len(h.clientsConn)),
+	}
+	for name, c := range h.clientsConn {
+		m.LatencyMs[name] = c.latency.Milliseconds()
+	}
+	return m, true
+}
+
+// Latency returns the round trip time of the last ping to the player, zero
+// before the first pong or while the player is disconnected
+func (h *Hub) Latency(player string) time.Duration {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.clientsConn[player].latency
+}
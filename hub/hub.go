@@ -1,41 +1,83 @@
 package hub
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/selvinnsikt/backend/model"
 	"log"
-	"math/rand"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type GameHub interface {
-	AddClientToHub(pc model.PlayerConnection)
+	AddClientToHub(pc model.PlayerConnection) error
 	// Broadcast a message to all client connceted to the hub
-	BroadcastMsg(msg interface{}) error
+	BroadcastMsg(msg interface{})
 	// Listen to all messages coming to the hub
-	GetBroadcastChan() chan model.Message
+	GetBroadcastChan() <-chan model.Message
 	// sends a message to the client
-	SendMsgToClient(msg interface{}, player string) error
+	SendMsgToClient(msg interface{}, player string)
 	// Get number of clients connected to the hub
 	GetNumberOfClientsConnected() int
 }
 
+var _ GameHub = (*Hub)(nil)
+
 var hubs *Hubs
 var writeWait = 5 * time.Second
 
-func InitHubs() {
+// Config decides how long players and hubs are kept around
+type Config struct {
+	// How long a player can be gone before the place in the hub is lost,
+	// 0 removes players at once
+	ReconnectGrace time.Duration
+	// Hubs where nothing has happened for this long are closed, 0 keeps them
+	IdleTTL time.Duration
+	// Hubs without players for this long are closed, 0 keeps them
+	EmptyTTL time.Duration
+	// What the hub IDs look like, five digits if the style is empty
+	Code CodeConfig
+	// How often clients are pinged, 0 turns the pings off
+	PingInterval time.Duration
+	// Clients that do not answer a ping within this are treated as gone.
+	// Must be longer than PingInterval
+	PongWait time.Duration
+	// How many messages can wait to be sent to one client, 64 if 0
+	SendQueueSize int
+	// What happens when the queue of a client is full, SlowCoalesce if empty
+	SlowClientPolicy string
+}
+
+// InitHubs creates the registry of hubs and starts closing idle and empty hubs
+func InitHubs(c Config) {
+	if c.Code.Style == "" {
+		c.Code = DefaultCodeConfig()
+	}
+	if c.SendQueueSize == 0 {
+		c.SendQueueSize = defaultSendQueueSize
+	}
+	if c.SlowClientPolicy == "" {
+		c.SlowClientPolicy = SlowCoalesce
+	}
 	hubs = &Hubs{
-		activeHubs: nil,
+		activeHubs: make(map[string]*Hub),
+		config:     c,
 		RWMutex:    &sync.RWMutex{},
 	}
+	go hubs.expireHubs()
 }
 
 type Hubs struct {
-	// A slice of all the active hubs
-	activeHubs []*Hub
+	// The active hubs keyed by hub ID
+	activeHubs map[string]*Hub
+	config     Config
+	// What happened to slow clients, updated atomically
+	slow slowCounters
 	*sync.RWMutex
 }
 
@@ -43,165 +85,590 @@ type Hubs struct {
 type Hub struct {
 	hubID                  string
 	clientsConn            map[string]Client
-	addClientChan          chan *model.PlayerConnection
-	removeClientChan       chan *model.PlayerConnection
 	broadcastChan          chan model.Message
 	numberClientsConnected int
 	mutex                  *sync.RWMutex
+	// Names of the connected players in the order they joined
+	joinOrder []string
+	// The player who joined first, passed on to the next player when the host leaves
+	host string
+	// Joining with this token makes the player host, given to the creator of the hub
+	hostToken string
+	// New players can not join a locked hub
+	locked bool
+	// Players the host has kicked can not join again
+	kicked map[string]bool
+	// Spectators and displays, they get broadcasts but can not play. Keyed by viewer ID
+	viewers map[string]Client
+	// Number of viewers that have attached, used to create the viewer IDs
+	viewersAdded int
+	// Settings chosen when the hub was created
+	settings model.HubSettings
+	// When a player last joined, left or sent a message
+	lastActivity time.Time
+	// Set when a player answers a ping, until the latencies are broadcasted
+	latencyChanged bool
+	// The registry the hub was created in
+	registry *Hubs
+	// Closed when the hub is shut down
+	done      chan struct{}
+	closeOnce *sync.Once
 }
 
 type Client struct {
-	Conn  *websocket.Conn
-	mutex *sync.RWMutex
+	// nil while the player is disconnected and can rejoin
+	Conn *websocket.Conn
+	// Sends the messages to Conn in order
+	writer *writer
+	// model.ROLE_PLAYER, model.ROLE_SPECTATOR or model.ROLE_DISPLAY
+	role string
+	// Session token the player rejoins with
+	token string
+	// When the player lost the connection, zero while connected
+	disconnectedAt time.Time
+	// Round trip time of the last ping
+	latency time.Duration
 }
 
-// NewHub creates a new hub
-func NewHub() (*Hub, string) {
-	// Accessing global slice of hubs
+// NewHub creates a new hub. Fails if every hub ID is in use
+func NewHub(settings model.HubSettings) (*Hub, string, error) {
+	// Accessing global registry of hubs
 	hubs.Lock()
 	defer hubs.Unlock()
-	hubID := generateHubID()
+	hubID, err := generateHubID()
+	if err != nil {
+		return nil, "", err
+	}
 
 	log.Printf("creating a hub with ID: '%s'\n", hubID)
 	// Creating a new hub
 	h := &Hub{
 		hubID:                  hubID,
 		clientsConn:            make(map[string]Client),
-		addClientChan:          make(chan *model.PlayerConnection),
-		removeClientChan:       make(chan *model.PlayerConnection),
 		broadcastChan:          make(chan model.Message),
 		numberClientsConnected: 0,
 		mutex:                  new(sync.RWMutex),
+		settings:               settings,
+		hostToken:              newSessionToken(),
+		kicked:                 make(map[string]bool),
+		viewers:                make(map[string]Client),
+		lastActivity:           time.Now(),
+		registry:               hubs,
+		done:                   make(chan struct{}),
+		closeOnce:              new(sync.Once),
+	}
+	hubs.activeHubs[hubID] = h
+	if hubs.config.PingInterval > 0 {
+		go h.broadcastLatencies(hubs.config.PingInterval)
 	}
-	hubs.activeHubs = append(hubs.activeHubs, h)
 
-	return h, h.hubID
+	return h, h.hubID, nil
 }
 
-func (h *Hub) run() {
-	for {
-		select {
-		case pc := <-h.addClientChan:
-			h.addClient(pc)
-		case pc := <-h.removeClientChan:
-			h.removeClient(pc)
+// HubID returns the ID the hub was created with
+func (h *Hub) HubID() string {
+	return h.hubID
+}
+
+// Settings returns the settings the hub was created with
+func (h *Hub) Settings() model.HubSettings {
+	return h.settings
+}
+
+// Done returns a channel that is closed when the hub is closed
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// ErrHubClosed is returned when a connection is added to a hub that is closed
+var ErrHubClosed = errors.New("the hub is closed")
+
+// isClosed checks if the hub is closed. Connections added while the mutex is
+// locked and the hub is not closed are closed by Close
+func (h *Hub) isClosed() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close removes the hub from the active hubs, closes the connection to every
+// client and signals everyone listening on Done()
+func (h *Hub) Close() {
+	h.close("the hub is closed")
+}
+
+// close tells the connected clients why the hub is closed before closing it
+func (h *Hub) close(reason string) {
+	h.closeOnce.Do(func() {
+		h.registry.remove(h)
+
+		log.Printf("closing hub '%s' - %s\n", h.hubID, reason)
+		close(h.done)
+
+		h.mutex.Lock()
+		clients := make([]Client, 0, len(h.clientsConn)+len(h.viewers))
+		for _, c := range h.clientsConn {
+			if c.Conn != nil {
+				clients = append(clients, c)
+			}
+		}
+		for _, c := range h.viewers {
+			clients = append(clients, c)
+		}
+		h.mutex.Unlock()
+
+		msg := model.HubClosed{PayloadType: model.PayloadType{Type: model.HUB_CLOSED}, Reason: reason}
+		for _, c := range clients {
+			c.writer.close(msg, websocket.CloseGoingAway, reason)
+		}
+	})
+}
+
+// expireHubs closes hubs that are idle or empty for too long
+func (hs *Hubs) expireHubs() {
+	interval := hs.config.IdleTTL
+	if interval == 0 || (hs.config.EmptyTTL > 0 && hs.config.EmptyTTL < interval) {
+		interval = hs.config.EmptyTTL
+	}
+	// Hubs are never closed
+	if interval == 0 {
+		return
+	}
+	// Check a few times per TTL, but not more often than needed
+	interval /= 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	for range time.Tick(interval) {
+		hs.RLock()
+		active := make([]*Hub, 0, len(hs.activeHubs))
+		for _, h := range hs.activeHubs {
+			active = append(active, h)
+		}
+		hs.RUnlock()
+		for _, h := range active {
+			if reason := h.expired(hs.config); reason != "" {
+				h.close(reason)
+			}
 		}
 	}
 }
 
-func (h *Hub) removeClient(np *model.PlayerConnection) {
+// expired returns why the hub should be closed, empty if it is still in use
+func (h *Hub) expired(c Config) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	idle := time.Since(h.lastActivity)
+	// Spectators and displays keep the hub alive as well as players
+	empty := len(h.clientsConn) == 0 && len(h.viewers) == 0
+	if c.EmptyTTL > 0 && empty && idle > c.EmptyTTL {
+		return fmt.Sprintf("nobody has been in the hub for %s", c.EmptyTTL)
+	}
+	if c.IdleTTL > 0 && idle > c.IdleTTL {
+		return fmt.Sprintf("nothing has happened in the hub for %s", c.IdleTTL)
+	}
+	return ""
+}
+
+// removeClient removes the client if the connection still belongs to the
+// player, returns false if it was already removed
+func (h *Hub) removeClient(np *model.PlayerConnection) bool {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 	defer np.Conn.Close()
+	if c, ok := h.clientsConn[np.Name]; !ok || c.Conn != np.Conn {
+		return false
+	}
 	log.Printf("deleting '%s from hub '%s' with IP '%s'\n", np.Name, h.hubID, np.Conn.RemoteAddr().String())
-	delete(h.clientsConn, np.Name)
 	h.numberClientsConnected--
+	h.deleteClient(np.Name)
+	return true
+}
+
+// deleteClient frees the name of the player and passes on the host.
+// Must be called with the mutex locked
+func (h *Hub) deleteClient(name string) {
+	delete(h.clientsConn, name)
+
+	for i, n := range h.joinOrder {
+		if n == name {
+			h.joinOrder = append(h.joinOrder[:i], h.joinOrder[i+1:]...)
+			break
+		}
+	}
+	// The player who has been in the hub the longest becomes the new host
+	if h.host == name {
+		h.host = ""
+		if len(h.joinOrder) > 0 {
+			h.host = h.joinOrder[0]
+		}
+	}
 }
-func (h *Hub) addClient(np *model.PlayerConnection) {
+
+// disconnectClient keeps the place of the player in the hub for the grace
+// period, so the player can rejoin with the session token. Returns false if
+// the connection does not belong to the player anymore
+func (h *Hub) disconnectClient(np *model.PlayerConnection) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	defer np.Conn.Close()
+	c, ok := h.clientsConn[np.Name]
+	if !ok || c.Conn != np.Conn {
+		return false
+	}
+	log.Printf("'%s' lost the connection to hub '%s', can rejoin within %s\n", np.Name, h.hubID, h.registry.config.ReconnectGrace)
+	at := time.Now()
+	c.Conn = nil
+	c.disconnectedAt = at
+	h.clientsConn[np.Name] = c
+	h.numberClientsConnected--
+
+	time.AfterFunc(h.registry.config.ReconnectGrace, func() {
+		if h.expireClient(np.Name, at) {
+			h.sendToGame(model.Message{Player: np.Name, Event: model.PLAYER_LEFT})
+		}
+	})
+	return true
+}
+
+// expireClient removes the player if it has not rejoined since it lost the
+// connection at the given time
+func (h *Hub) expireClient(name string, at time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	c, ok := h.clientsConn[name]
+	if !ok || c.Conn != nil || !c.disconnectedAt.Equal(at) {
+		return false
+	}
+	log.Printf("'%s' did not rejoin hub '%s' in time\n", name, h.hubID)
+	h.deleteClient(name)
+	return true
+}
+
+// addClient adds the player to the hub and starts the writer of the
+// connection. The name, kicked players and the lock are checked again under
+// the lock, since they can change after ValidateHubAndPlayerName
+func (h *Hub) addClient(np *model.PlayerConnection) (*writer, error) {
+	token := newSessionToken()
+
 	// Add client to Game Room
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
+	if h.isClosed() {
+		return nil, ErrHubClosed
+	}
+	if _, taken := h.clientsConn[np.Name]; taken {
+		return nil, fmt.Errorf("name '%s' is already taken in hub '%s'", np.Name, h.hubID)
+	}
+	if err := h.joinAllowed(np.Name, np.HostToken); err != nil {
+		return nil, err
+	}
 	log.Printf("adding '%s to hub '%s' with IP '%s' \n", np.Name, h.hubID, np.Conn.RemoteAddr().String())
-	h.clientsConn[np.Name] = Client{
-		Conn:  np.Conn,
-		mutex: new(sync.RWMutex),
+	c := Client{
+		Conn:   np.Conn,
+		writer: newWriter(np.Conn, h, np.Name),
+		role:   model.ROLE_PLAYER,
+		token:  token,
 	}
+	h.clientsConn[np.Name] = c
 	h.numberClientsConnected++
-	// Send to player that the connection was successful
-	h.SendMsgToClient(model.ConnSuccess{PayloadType: model.PayloadType{Type: "ConnectionSuccess"}},np.Name)
-}
+	h.joinOrder = append(h.joinOrder, np.Name)
+	if h.host == "" || h.isHostToken(np.HostToken) {
+		h.host = np.Name
+	}
 
-// addClientToHub adds the player to the given hub ID
-func (h *Hub) AddClientToHub(pc model.PlayerConnection) {
+	// Send to player that the connection was successful. Queued before the
+	// lock is released, so it is the first message the player gets
+	c.send(model.ConnSuccess{
+		PayloadType:  model.PayloadType{Type: model.CONNECTION_SUCCESS},
+		Player:       np.Name,
+		SessionToken: token,
+		Role:         model.ROLE_PLAYER,
+	})
+	return c.writer, nil
+}
 
-	go h.run()
+// addClientToHub adds the player to the given hub ID. A connection that can
+// not be added is closed
+func (h *Hub) AddClientToHub(pc model.PlayerConnection) error {
 
 	// Adding the connection to gameroom
-	h.addClientChan <- &pc
+	w, err := h.addClient(&pc)
+	if err != nil {
+		rejectConn(pc.Conn, err.Error())
+		return err
+	}
 
 	// Read the messages sent from the client
-	go h.readMessageFromClient(&pc)
+	go h.readMessageFromClient(&pc, w, model.PLAYER_JOINED)
+	return nil
+}
+
+// RejoinHub attaches a new connection to a player who has lost the
+// connection. An old connection that is still open is closed. The token is
+// checked again, since the player can be removed after ValidateRejoin. A
+// connection that can not rejoin is closed
+func (h *Hub) RejoinHub(pc model.PlayerConnection, token string) error {
+	h.mutex.Lock()
+	if h.isClosed() {
+		h.mutex.Unlock()
+		rejectConn(pc.Conn, ErrHubClosed.Error())
+		return ErrHubClosed
+	}
+	c, ok := h.clientsConn[pc.Name]
+	if !ok || subtle.ConstantTimeCompare([]byte(c.token), []byte(token)) != 1 {
+		h.mutex.Unlock()
+		err := fmt.Errorf("no session for '%s' in hub '%s' with the given token", pc.Name, h.hubID)
+		rejectConn(pc.Conn, err.Error())
+		return err
+	}
+	if c.Conn != nil {
+		// The old connection is replaced, its reader stops without removing the player
+		c.Conn.Close()
+	} else {
+		h.numberClientsConnected++
+	}
+	log.Printf("'%s' rejoined hub '%s' with IP '%s'\n", pc.Name, h.hubID, pc.Conn.RemoteAddr().String())
+	c.Conn = pc.Conn
+	c.writer = newWriter(pc.Conn, h, pc.Name)
+	c.disconnectedAt = time.Time{}
+	c.latency = 0
+	h.clientsConn[pc.Name] = c
+	c.send(model.ConnSuccess{
+		PayloadType:  model.PayloadType{Type: model.CONNECTION_SUCCESS},
+		Player:       pc.Name,
+		SessionToken: c.token,
+		Rejoined:     true,
+		Role:         model.ROLE_PLAYER,
+	})
+	h.mutex.Unlock()
+
+	go h.readMessageFromClient(&pc, c.writer, model.PLAYER_RECONNECTED)
+	return nil
+}
 
+// rejectConn closes a connection that was upgraded but can not be added to
+// the hub, and tells the client why
+func rejectConn(conn *websocket.Conn, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(writeWait))
+	conn.Close()
 }
 
-// readMessageFromClient reads incoming messages and sent it to incomingMsgChan
-func (h *Hub) readMessageFromClient(pc *model.PlayerConnection) {
+// readMessageFromClient reads incoming messages and sent it to incomingMsgChan.
+// The first message is the event that the player joined or reconnected, and
+// the last is the event that the player left or lost the connection
+func (h *Hub) readMessageFromClient(pc *model.PlayerConnection, w *writer, event string) {
+	defer w.halt()
+	if !h.sendToGame(model.Message{Player: pc.Name, Event: event}) {
+		pc.Conn.Close()
+		return
+	}
+	stopHeartbeat := h.heartbeat(pc)
+	defer stopHeartbeat()
 	var m model.Message
 	for {
 		_, msg, err := pc.Conn.ReadMessage()
 		if err != nil {
+			// Every client is gone when the hub is closed
+			select {
+			case <-h.done:
+				return
+			default:
+			}
 			// not the best, should find error msg from websocket package
 			if err.Error() != "websocket: close 1000 (normal)" {
 				log.Println("ERROR - bad read from client connection - " + err.Error())
 			}
+			// Players who close the connection on purpose leave at once
+			left := websocket.IsCloseError(err, websocket.CloseNormalClosure)
+			if h.registry.config.ReconnectGrace > 0 && !left && h.disconnectClient(pc) {
+				h.sendToGame(model.Message{Player: pc.Name, Event: model.PLAYER_DISCONNECTED})
+				return
+			}
 			h.removeClient(pc)
+			h.sendToGame(model.Message{Player: pc.Name, Event: model.PLAYER_LEFT})
 			return
 		}
 		// add name of client who sent the message
 		m.Player = pc.Name
 		m.Text = string(msg)
-		h.broadcastChan <- m
+		if !h.sendToGame(m) {
+			return
+		}
 	}
 }
 
+// sendToGame passes the message on to the broadcast channel, returns false
+// if the hub is closed
+func (h *Hub) sendToGame(m model.Message) bool {
+	h.mutex.Lock()
+	h.lastActivity = time.Now()
+	h.mutex.Unlock()
+	select {
+	case h.broadcastChan <- m:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Host returns the name of the host, empty if nobody is connected
+func (h *Hub) Host() string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.host
+}
+
+// HostToken returns the token that makes the player joining with it host
+func (h *Hub) HostToken() string {
+	return h.hostToken
+}
+
+// isHostToken compares the token with the host token in constant time
+func (h *Hub) isHostToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.hostToken)) == 1
+}
+
+// SetHost passes the host role on to another player in the hub
+func (h *Hub) SetHost(player string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if c, ok := h.clientsConn[player]; !ok || c.Conn == nil {
+		return fmt.Errorf("'%s' is not connected to the hub", player)
+	}
+	log.Printf("'%s' is the new host of hub '%s'\n", player, h.hubID)
+	h.host = player
+	return nil
+}
+
+// Locked checks if new players are stopped from joining
+func (h *Hub) Locked() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.locked
+}
+
+// SetLocked stops or lets new players join the hub. Players who lost the
+// connection can still rejoin
+func (h *Hub) SetLocked(locked bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.locked = locked
+}
+
+// Kick removes the player from the hub and stops the name from joining
+// again. The player is told why before the connection is closed. Returns
+// false if the player had lost the connection, then nobody else reports that
+// the player left
+func (h *Hub) Kick(player, reason string) (bool, error) {
+	h.mutex.Lock()
+	c, ok := h.clientsConn[player]
+	if !ok {
+		h.mutex.Unlock()
+		return false, fmt.Errorf("'%s' is not in the hub", player)
+	}
+	log.Printf("kicking '%s' from hub '%s'\n", player, h.hubID)
+	if c.Conn != nil {
+		h.numberClientsConnected--
+	}
+	h.kicked[player] = true
+	h.deleteClient(player)
+	h.mutex.Unlock()
+
+	if c.Conn == nil {
+		return false, nil
+	}
+	// The reader of the connection fails and reports that the player left
+	c.writer.close(model.Kicked{PayloadType: model.PayloadType{Type: model.KICKED}, Reason: reason}, websocket.ClosePolicyViolation, reason)
+	return true, nil
+}
+
+// Players returns the names of the connected players in the order they joined
+func (h *Hub) Players() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return append([]string(nil), h.joinOrder...)
+}
+
+// IsConnected checks if a player with the name is in the hub, also while
+// the player can rejoin after losing the connection
+func (h *Hub) IsConnected(player string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	_, ok := h.clientsConn[player]
+	return ok
+}
+
+// IsOnline checks if the player has an open connection to the hub
+func (h *Hub) IsOnline(player string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.clientsConn[player].Conn != nil
+}
+
 // SendMsgToClient is a implementation from the GameHub interface and
 // is used by game.go
 func (h *Hub) SendMsgToClient(msg interface{}, player string) {
-	if c, ok := h.clientsConn[player]; ok {
-		err := c.sendMsg(msg)
-		if err != nil {
-			h.removeClientChan <- &model.PlayerConnection{
-				Name: player,
-				Conn: c.Conn,
-			}
-		}
+	h.mutex.RLock()
+	c, ok := h.clientsConn[player]
+	h.mutex.RUnlock()
+	if ok && c.Conn == nil {
+		// The player has lost the connection and gets the state on rejoin
+		return
+	}
+	if ok {
+		c.send(msg)
 	} else {
 		log.Printf("did not find any player in hub '%s' with name '%s'\n", h.hubID, player)
 	}
 }
 
-// sendMsg is a thread-safe way to send message to client
-func (c *Client) sendMsg(msg interface{}) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	err := c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	err = c.Conn.WriteJSON(msg)
-	if err != nil {
-		return err
-	}
-	return nil
+// send queues the message for the client
+func (c Client) send(msg interface{}) {
+	c.writer.send(msg)
 }
 
 func (h *Hub) GetBroadcastChan() <-chan model.Message {
 	return h.broadcastChan
 }
 
+// GetNumberOfClientsConnected returns how many players have an open
+// connection. Spectators are not counted
 func (h *Hub) GetNumberOfClientsConnected() int {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 	return h.numberClientsConnected
 }
+
+// BroadcastMsg sends the message to every connected player, spectator and display
 func (h *Hub) BroadcastMsg(msg interface{}) {
+	h.BroadcastToRole(msg, model.ROLE_ALL)
+}
+
+// BroadcastToRole sends the message only to the connections with the role,
+// or to everyone with model.ROLE_ALL
+func (h *Hub) BroadcastToRole(msg interface{}, role string) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
-	for name, client := range h.clientsConn {
-		client := client
-		name := name
-		go func(c *Client, n string) {
-			err := c.sendMsg(msg)
-			if err != nil {
-				log.Printf("error occurred while broadcasting message to IP '%s' , errorMsg: %s \n", c.Conn.RemoteAddr().String(), err.Error())
-				h.removeClientChan <- &model.PlayerConnection{
-					Name: n,
-					Conn: c.Conn,
-				}
+	if role == model.ROLE_ALL || role == model.ROLE_PLAYER {
+		for _, client := range h.clientsConn {
+			if client.Conn == nil {
+				continue
 			}
-		}(&client, name)
-
+			client.send(msg)
+		}
+	}
+	for _, client := range h.viewers {
+		if role == model.ROLE_ALL || role == client.role {
+			client.send(msg)
+		}
 	}
 }
 
@@ -217,56 +684,142 @@ func ValidateHubAndPlayerName(np model.NewPlayer) (*Hub, error) {
 	if ok := h.playerNameAvailableInHub(np.Name); !ok {
 		return nil, fmt.Errorf("name '%s' is already taken in hub '%s ", np.Name, np.HubID)
 	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if err := h.joinAllowed(np.Name, np.HostToken); err != nil {
+		return nil, err
+	}
 	return h, nil
 }
 
-// generateHubID creates a 5 digit string and check if it is available
-func generateHubID() string {
-	var exists = false
-	var roomID string
-	for !exists {
-		// Generate a random 5 digit number
-		var n int
-		for i := 0; i < 5; i++ {
-			n = rand.Intn(9)
-			roomID += strconv.Itoa(n)
-		}
+// joinAllowed checks that the name is not a viewer ID, that the player is not
+// kicked and that the lobby is open. Must be called with the mutex locked
+func (h *Hub) joinAllowed(name, hostToken string) error {
+	// The game tells players and viewers apart by the name, so a player named
+	// like a viewer would get the state of the viewer and the other way around
+	if _, ok := h.viewers[name]; ok || isViewerID(name) {
+		return fmt.Errorf("name '%s' is reserved for spectators and displays in hub '%s'", name, h.hubID)
+	}
+	if h.kicked[name] {
+		return fmt.Errorf("'%s' was kicked from hub '%s'", name, h.hubID)
+	}
+	// The creator of the hub can always join
+	if h.locked && !h.isHostToken(hostToken) {
+		return ErrHubLocked
+	}
+	return nil
+}
+
+// ErrHubLocked is returned when joining a hub the host has locked
+var ErrHubLocked = errors.New("the hub is locked")
+
+// ValidateRejoin checks that the player is in the hub and that the session
+// token belongs to the player
+func ValidateRejoin(np model.NewPlayer, token string) (*Hub, error) {
+	h, err := getHub(np.HubID)
+	if err != nil {
+		return nil, err
+	}
+	h.mutex.RLock()
+	c, ok := h.clientsConn[np.Name]
+	h.mutex.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(c.token), []byte(token)) != 1 {
+		return nil, fmt.Errorf("no session for '%s' in hub '%s' with the given token", np.Name, np.HubID)
+	}
+	return h, nil
+}
+
+// newSessionToken creates a random token the player can rejoin with
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Println("ERROR - unable to create session token - " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ErrNoHubIDs is returned when every hub ID is in use
+var ErrNoHubIDs = errors.New("every hub ID is in use, try again later")
+
+// generateHubID creates a code in the configured style that no other hub uses.
+// Must be called with the hubs locked
+func generateHubID() (string, error) {
+	if codesRemaining() <= 0 {
+		return "", ErrNoHubIDs
+	}
+	for {
+		roomID := hubs.config.Code.generate()
 		// Check if room exist
-		exists = hubExists(roomID)
+		if !hubExists(roomID) {
+			return roomID, nil
+		}
 	}
-	return roomID
+}
+
+// codesRemaining returns how many hub IDs are not in use.
+// Must be called with the hubs locked
+func codesRemaining() int64 {
+	return hubs.config.Code.total() - int64(len(hubs.activeHubs))
+}
+
+// Stats returns the number of active hubs and how many hub IDs are left
+func Stats() model.HubStats {
+	hubs.RLock()
+	defer hubs.RUnlock()
+	return model.HubStats{
+		ActiveHubs:     len(hubs.activeHubs),
+		CodeStyle:      hubs.config.Code.Style,
+		CodeLength:     hubs.config.Code.Length,
+		TotalCodes:     hubs.config.Code.total(),
+		CodesRemaining: codesRemaining(),
+		SlowClients: model.SlowClientStats{
+			Policy:       hubs.config.SlowClientPolicy,
+			QueueSize:    hubs.config.SendQueueSize,
+			Dropped:      atomic.LoadInt64(&hubs.slow.dropped),
+			Coalesced:    atomic.LoadInt64(&hubs.slow.coalesced),
+			Disconnected: atomic.LoadInt64(&hubs.slow.disconnected),
+		},
+	}
+}
+
+// NumberOfHubs returns how many hubs are active
+func NumberOfHubs() int {
+	hubs.RLock()
+	defer hubs.RUnlock()
+	return len(hubs.activeHubs)
 }
 
 // getHub find the correct based on id and return pointer of room
 func getHub(id string) (*Hub, error) {
 	hubs.RLock()
 	defer hubs.RUnlock()
-	for _, gr := range hubs.activeHubs {
-		if gr.hubID == id {
-			return gr, nil
-		}
+	h, ok := hubs.activeHubs[hubs.config.Code.normalize(id)]
+	if !ok {
+		return nil, fmt.Errorf("did not find any room with id '%s'", id)
 	}
-	return nil, fmt.Errorf("did not find any room with id '%s'", id)
+	return h, nil
+}
 
+// remove deletes the hub from the registry, unless the ID is used by another hub
+func (hs *Hubs) remove(h *Hub) {
+	hs.Lock()
+	defer hs.Unlock()
+	if hs.activeHubs[h.hubID] == h {
+		delete(hs.activeHubs, h.hubID)
+	}
 }
 
-// playerNameAvailableInHub loops through usernames and checks for duplicated names
+// playerNameAvailableInHub checks that no player in the hub has the name
 func (h *Hub) playerNameAvailableInHub(n string) bool {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
-	for name, _ := range h.clientsConn {
-		if name == n {
-			return false
-		}
-	}
-	return true
+	_, taken := h.clientsConn[n]
+	return !taken
 }
 
+// hubExists checks if a hub uses the ID. Must be called with the hubs locked
 func hubExists(id string) bool {
-	for _, gr := range hubs.activeHubs {
-		if gr.hubID == id {
-			return false
-		}
-	}
-	return true
+	_, ok := hubs.activeHubs[id]
+	return ok
 }
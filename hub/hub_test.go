@@ -0,0 +1,618 @@
+package hub
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/selvinnsikt/backend/model"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveHub lets websockets join the hub on the returned url, and throws away
+// the messages the hub sends to the game
+func serveHub(t *testing.T, h *Hub) string {
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if role := r.URL.Query().Get("viewer"); role != "" {
+			h.AddViewerToHub(conn, role)
+			return
+		}
+		h.AddClientToHub(model.PlayerConnection{Name: r.URL.Query().Get("player"), Conn: conn})
+	}))
+	t.Cleanup(s.Close)
+	go func() {
+		for {
+			select {
+			case <-h.GetBroadcastChan():
+			case <-h.Done():
+				return
+			}
+		}
+	}()
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func TestIdleHubIsClosed(t *testing.T) {
+	InitHubs(Config{IdleTTL: 200 * time.Millisecond})
+	h := newHub(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(serveHub(t, h)+"?player=ola", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var success model.ConnSuccess
+	if err := conn.ReadJSON(&success); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is told why before the connection is closed
+	var closed model.HubClosed
+	if err := conn.ReadJSON(&closed); err != nil {
+		t.Fatal(err)
+	}
+	if closed.Type != model.HUB_CLOSED || closed.Reason == "" {
+		t.Errorf("FAIL - expected %s with a reason, got %+v", model.HUB_CLOSED, closed)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("FAIL - expected close code %d, got %v", websocket.CloseGoingAway, err)
+	}
+
+	select {
+	case <-h.Done():
+	default:
+		t.Errorf("FAIL - expected the hub to be done")
+	}
+	if NumberOfHubs() != 0 {
+		t.Errorf("FAIL - expected no active hubs, got %d", NumberOfHubs())
+	}
+}
+
+func TestEmptyHubIsClosed(t *testing.T) {
+	InitHubs(Config{IdleTTL: time.Hour, EmptyTTL: 100 * time.Millisecond})
+	empty := newHub(t)
+	h := newHub(t)
+	watched := newHub(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(serveHub(t, h)+"?player=ola", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	viewer, _, err := websocket.DefaultDialer.Dial(serveHub(t, watched)+"?viewer="+model.ROLE_SPECTATOR, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+
+	select {
+	case <-empty.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("FAIL - expected the empty hub to be closed")
+	}
+
+	// The hub with a player is kept
+	time.Sleep(200 * time.Millisecond)
+	if _, err := getHub(h.HubID()); err != nil {
+		t.Errorf("FAIL - expected the hub with a player to be active - %s", err.Error())
+	}
+	if _, err := getHub(watched.HubID()); err != nil {
+		t.Errorf("FAIL - expected the hub with a spectator to be active - %s", err.Error())
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	InitHubs(Config{PingInterval: 50 * time.Millisecond, PongWait: 200 * time.Millisecond})
+	h := newHub(t)
+	u := serveHub(t, h)
+
+	// ola answers the pings while reading, per never reads
+	ola, _, err := websocket.DefaultDialer.Dial(u+"?player=ola", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	go func() {
+		for {
+			if _, _, err := ola.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	per, _, err := websocket.DefaultDialer.Dial(u+"?player=per", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer per.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.IsConnected("per") && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if h.IsConnected("per") {
+		t.Errorf("FAIL - expected per to be removed after not answering the pings")
+	}
+	if !h.IsOnline("ola") {
+		t.Errorf("FAIL - expected ola to stay connected")
+	}
+	if h.Latency("ola") <= 0 {
+		t.Errorf("FAIL - expected the latency of ola to be measured")
+	}
+}
+
+func TestLatencyIsSentOnPong(t *testing.T) {
+	InitHubs(Config{PingInterval: 50 * time.Millisecond, PongWait: time.Second})
+	h := newHub(t)
+	u := serveHub(t, h)
+	start := time.Now()
+
+	ola, _, err := websocket.DefaultDialer.Dial(u+"?player=ola", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	// per answers the pings as well, without adding more Latency messages
+	per, _, err := websocket.DefaultDialer.Dial(u+"?player=per", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer per.Close()
+	go func() {
+		for {
+			if _, _, err := per.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// The first ping is answered at once, the later ones after a delay
+	pings := 0
+	ola.SetPingHandler(func(data string) error {
+		if pings++; pings > 1 {
+			time.Sleep(30 * time.Millisecond)
+		}
+		return ola.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	var latencies []int64
+	messages := 0
+	ola.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(latencies) < 2 || latencies[len(latencies)-1] < 30 {
+		var m model.Latency
+		if err := ola.ReadJSON(&m); err != nil {
+			t.Fatalf("FAIL - expected a later Latency of at least 30ms, got %v - %v", latencies, err)
+		}
+		if m.Type != model.LATENCY {
+			continue
+		}
+		messages++
+		if latency, ok := m.LatencyMs["ola"]; ok {
+			latencies = append(latencies, latency)
+		}
+	}
+	// At most one message per ping interval for the whole hub
+	if max := int(time.Since(start)/(50*time.Millisecond)) + 1; messages > max {
+		t.Errorf("FAIL - expected at most %d Latency messages, got %d", max, messages)
+	}
+	if latencies[0] >= 30 {
+		t.Errorf("FAIL - expected the first Latency to be below 30ms, got %v", latencies)
+	}
+	if got := h.Latency("ola").Milliseconds(); got < 30 {
+		t.Errorf("FAIL - expected the stored latency to be at least 30ms, got %d", got)
+	}
+}
+
+func TestMessagesAreSentInOrder(t *testing.T) {
+	InitHubs(Config{})
+	h := newHub(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(serveHub(t, h)+"?player=ola", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var success model.ConnSuccess
+	if err := conn.ReadJSON(&success); err != nil || success.Type != model.CONNECTION_SUCCESS {
+		t.Fatalf("FAIL - expected %s first, got %+v, %v", model.CONNECTION_SUCCESS, success, err)
+	}
+
+	n := defaultSendQueueSize / 2
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			h.BroadcastMsg(model.PlayersVotesToQuestionReceived{Question: i})
+		} else {
+			h.SendMsgToClient(model.PlayersVotesToQuestionReceived{Question: i}, "ola")
+		}
+	}
+	for i := 0; i < n; i++ {
+		var m model.PlayersVotesToQuestionReceived
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Question != i {
+			t.Fatalf("FAIL - expected message %d, got %d", i, m.Question)
+		}
+	}
+}
+
+func TestRejoinAfterRemoval(t *testing.T) {
+	InitHubs(Config{ReconnectGrace: time.Hour})
+	h := newHub(t)
+
+	ola, _, err := websocket.DefaultDialer.Dial(serveHub(t, h)+"?player=ola", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	var success model.ConnSuccess
+	if err := ola.ReadJSON(&success); err != nil {
+		t.Fatal(err)
+	}
+
+	// ola is removed after the token was validated, but before the rejoin
+	if _, err := h.Kick("ola", "gone"); err != nil {
+		t.Fatal(err)
+	}
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := h.RejoinHub(model.PlayerConnection{Name: "ola", Conn: conn}, success.SessionToken); err == nil {
+			t.Error("FAIL - expected the rejoin to be rejected")
+		}
+	}))
+	defer s.Close()
+	again, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	again.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := again.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("FAIL - expected close code %d, got %v", websocket.ClosePolicyViolation, err)
+	}
+	if h.IsConnected("ola") || h.GetNumberOfClientsConnected() != 0 {
+		t.Errorf("FAIL - expected no ghost of ola in the hub")
+	}
+}
+
+func TestDuplicateNameIsRejected(t *testing.T) {
+	InitHubs(Config{})
+	h := newHub(t)
+	u := serveHub(t, h)
+
+	ola, _, err := websocket.DefaultDialer.Dial(u+"?player=ola", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	// The second join skips ValidateHubAndPlayerName, as when both pass it at once
+	again, _, err := websocket.DefaultDialer.Dial(u+"?player=ola", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	again.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := again.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("FAIL - expected close code %d, got %v", websocket.ClosePolicyViolation, err)
+	}
+	if players := h.Players(); len(players) != 1 || h.GetNumberOfClientsConnected() != 1 {
+		t.Errorf("FAIL - expected ola once in the hub, got %v", players)
+	}
+}
+
+func TestLockAndKickAreCheckedOnJoin(t *testing.T) {
+	InitHubs(Config{})
+	h := newHub(t)
+	u := serveHub(t, h)
+
+	// The lobby is locked and per kicked after the joins were validated
+	h.SetLocked(true)
+	h.mutex.Lock()
+	h.kicked["per"] = true
+	h.mutex.Unlock()
+	for _, name := range []string{"ola", "per"} {
+		conn, _, err := websocket.DefaultDialer.Dial(u+"?player="+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("FAIL - expected %s to be closed with code %d, got %v", name, websocket.ClosePolicyViolation, err)
+		}
+	}
+	if players := h.Players(); len(players) != 0 {
+		t.Errorf("FAIL - expected nobody in the hub, got %v", players)
+	}
+}
+
+func TestViewerNamesAreReserved(t *testing.T) {
+	InitHubs(Config{})
+	h := newHub(t)
+	u := serveHub(t, h)
+
+	viewer, _, err := websocket.DefaultDialer.Dial(u+"?viewer="+model.ROLE_SPECTATOR, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+
+	for _, name := range []string{"spectator-1", "display-7"} {
+		if _, err := ValidateHubAndPlayerName(model.NewPlayer{Name: name, HubID: h.HubID()}); err == nil {
+			t.Errorf("FAIL - expected '%s' to be rejected before the upgrade", name)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(u+"?player="+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("FAIL - expected %s to be closed with code %d, got %v", name, websocket.ClosePolicyViolation, err)
+		}
+	}
+	if players := h.Players(); len(players) != 0 {
+		t.Errorf("FAIL - expected no players in the hub, got %v", players)
+	}
+}
+
+func TestJoinClosedHub(t *testing.T) {
+	InitHubs(Config{})
+	h := newHub(t)
+	u := serveHub(t, h)
+
+	// The hub is closed after the joins were validated
+	h.Close()
+	for _, query := range []string{"?player=ola", "?viewer=" + model.ROLE_SPECTATOR} {
+		conn, _, err := websocket.DefaultDialer.Dial(u+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("FAIL - expected %s to be closed with code %d, got %v", query, websocket.ClosePolicyViolation, err)
+		}
+	}
+	if players, viewers := h.Players(), h.NumberOfViewers(model.ROLE_SPECTATOR); len(players) != 0 || viewers != 0 {
+		t.Errorf("FAIL - expected nobody in the closed hub, got %v and %d viewers", players, viewers)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	InitHubs(Config{})
+	h := newHub(t)
+	id := h.HubID()
+	if !hubExists(id) {
+		t.Errorf("FAIL - expected hub '%s' to exist", id)
+	}
+	if got, err := getHub(id); err != nil || got != h {
+		t.Errorf("FAIL - expected to find hub '%s', got %v, %v", id, got, err)
+	}
+	if NumberOfHubs() != 1 {
+		t.Errorf("FAIL - expected 1 active hub, got %d", NumberOfHubs())
+	}
+
+	// A closed hub does not remove a new hub that got the same ID
+	other := &Hub{hubID: id}
+	hubs.remove(other)
+	if !hubExists(id) {
+		t.Errorf("FAIL - expected hub '%s' to be kept", id)
+	}
+
+	h.Close()
+	if hubExists(id) {
+		t.Errorf("FAIL - expected hub '%s' to be removed", id)
+	}
+	if _, err := getHub(id); err == nil {
+		t.Errorf("FAIL - expected lookup of closed hub '%s' to fail", id)
+	}
+}
+
+func newHub(t *testing.T) *Hub {
+	h, _, err := NewHub(model.HubSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHubCodeStyles(t *testing.T) {
+	tests := []struct {
+		code   CodeConfig
+		format *regexp.Regexp
+	}{
+		{CodeConfig{Style: CodeDigits}, regexp.MustCompile(`^[0-9]{5}$`)},
+		{CodeConfig{Style: CodeDigits, Length: 7}, regexp.MustCompile(`^[0-9]{7}$`)},
+		{CodeConfig{Style: CodeLetters}, regexp.MustCompile(`^[A-HJKMNP-Z]{4}$`)},
+		{CodeConfig{Style: CodeWords}, regexp.MustCompile(`^[a-z]+-[a-z]+-[a-z]+$`)},
+		{CodeConfig{Style: CodeWords, Length: 4}, regexp.MustCompile(`^[a-z]+-[a-z]+-[a-z]+-[a-z]+$`)},
+	}
+	for _, test := range tests {
+		if err := test.code.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		InitHubs(Config{Code: test.code})
+		seen := make(map[string]bool)
+		for i := 0; i < 500; i++ {
+			id := newHub(t).HubID()
+			if seen[id] {
+				t.Fatalf("FAIL - hub ID '%s' was given out twice", id)
+			}
+			if !test.format.MatchString(id) {
+				t.Fatalf("FAIL - hub ID '%s' does not match %s", id, test.format)
+			}
+			seen[id] = true
+		}
+	}
+
+	// Too few codes are rejected as well
+	for _, invalid := range []CodeConfig{
+		{Style: "emoji"}, {Style: CodeDigits, Length: 2}, {Style: CodeWords, Length: 5},
+		{Style: CodeDigits, Length: 4}, {Style: CodeLetters, Length: 3}, {Style: CodeWords, Length: 2},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("FAIL - expected %+v to be invalid", invalid)
+		}
+	}
+}
+
+func TestLetterCodesIgnoreCase(t *testing.T) {
+	InitHubs(Config{Code: CodeConfig{Style: CodeLetters, Length: 4}})
+	h := newHub(t)
+	if got, err := getHub(strings.ToLower(h.HubID())); err != nil || got != h {
+		t.Errorf("FAIL - expected to find hub '%s' in lower case, got %v", h.HubID(), err)
+	}
+}
+
+func TestCodesRemaining(t *testing.T) {
+	InitHubs(Config{Code: CodeConfig{Style: CodeDigits, Length: 3}})
+	if s := Stats(); s.TotalCodes != 1000 || s.CodesRemaining != 1000 {
+		t.Fatalf("FAIL - expected 1000 codes, got %+v", s)
+	}
+
+	// Every digit is used, including 9
+	digits := make(map[rune]bool)
+	for i := 0; i < 1000; i++ {
+		for _, d := range newHub(t).HubID() {
+			digits[d] = true
+		}
+	}
+	if len(digits) != 10 {
+		t.Errorf("FAIL - expected all 10 digits to be used, got %d", len(digits))
+	}
+	if s := Stats(); s.ActiveHubs != 1000 || s.CodesRemaining != 0 {
+		t.Errorf("FAIL - expected no codes left, got %+v", s)
+	}
+	if _, _, err := NewHub(model.HubSettings{}); err != ErrNoHubIDs {
+		t.Errorf("FAIL - expected %v, got %v", ErrNoHubIDs, err)
+	}
+}
+
+// fillRegistry registers n hubs without starting their goroutines
+func fillRegistry(n int) []string {
+	InitHubs(Config{})
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		hubs.activeHubs[ids[i]] = &Hub{hubID: ids[i]}
+	}
+	return ids
+}
+
+func BenchmarkGetHub100k(b *testing.B) {
+	ids := fillRegistry(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getHub(ids[i%len(ids)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetHub100kParallel(b *testing.B) {
+	ids := fillRegistry(100000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := getHub(ids[i%len(ids)]); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkGetMissingHub100k(b *testing.B) {
+	fillRegistry(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		getHub("missing")
+	}
+}
+
+func TestSlowClientPolicies(t *testing.T) {
+	roster := func(ready int) model.LobbyRoster {
+		return model.LobbyRoster{PayloadType: model.PayloadType{Type: model.LOBBY_ROSTER}, NumberReady: ready}
+	}
+	received := model.PlayersVotesToQuestionReceived{PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION_RECIEVED}}
+	timer := model.PhaseTimer{PayloadType: model.PayloadType{Type: model.PHASE_TIMER}}
+
+	tests := []struct {
+		policy string
+		// What is left in the queue after the roster overflows it
+		afterRoster []string
+		want        model.SlowClientStats
+	}{
+		{SlowCoalesce, []string{model.PLAYERS_VOTE_TO_QUESTION_RECIEVED, model.LOBBY_ROSTER}, model.SlowClientStats{Coalesced: 1, Dropped: 1, Disconnected: 1}},
+		{SlowDrop, []string{model.LOBBY_ROSTER, model.PLAYERS_VOTE_TO_QUESTION_RECIEVED}, model.SlowClientStats{Dropped: 2, Disconnected: 1}},
+		{SlowDisconnect, []string{""}, model.SlowClientStats{Disconnected: 1}},
+	}
+	for _, test := range tests {
+		InitHubs(Config{SendQueueSize: 2, SlowClientPolicy: test.policy})
+		// The writer is not started, so nothing leaves the queue
+		w := makeWriter(nil, newHub(t), "ola")
+		w.send(roster(1))
+		w.send(received)
+		w.send(roster(2))
+
+		var got []string
+		for _, o := range w.pending {
+			got = append(got, payloadName(o.msg))
+		}
+		if strings.Join(got, ",") != strings.Join(test.afterRoster, ",") {
+			t.Errorf("FAIL - %s: expected %v in the queue, got %v", test.policy, test.afterRoster, got)
+		}
+		if test.policy == SlowCoalesce {
+			if r := w.pending[1].msg.(model.LobbyRoster); r.NumberReady != 2 {
+				t.Errorf("FAIL - %s: expected the newest roster to be kept, got %+v", test.policy, r)
+			}
+		}
+
+		// A timer can be dropped, but an ack that does not fit disconnects the client
+		w.send(timer)
+		w.send(received)
+		if n := len(w.pending); n != 1 || w.pending[0].closeCode != model.CLOSE_SLOW_CLIENT {
+			t.Errorf("FAIL - %s: expected only a close with code %d in the queue, got %+v", test.policy, model.CLOSE_SLOW_CLIENT, w.pending)
+		}
+
+		stats := Stats().SlowClients
+		stats.Policy, stats.QueueSize = "", 0
+		if stats != test.want {
+			t.Errorf("FAIL - %s: expected %+v, got %+v", test.policy, test.want, stats)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := Config{}
+	if err := c.Validate(); err != nil || c.SendQueueSize != defaultSendQueueSize || c.SlowClientPolicy != SlowCoalesce {
+		t.Errorf("FAIL - expected the defaults, got %+v, %v", c, err)
+	}
+	for _, c := range []Config{
+		{SlowClientPolicy: "ignore"},
+		{SendQueueSize: -1},
+		{PingInterval: time.Second, PongWait: time.Second},
+		{Code: CodeConfig{Style: CodeDigits, Length: 3}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("FAIL - expected %+v to be invalid", c)
+		}
+	}
+}
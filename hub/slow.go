@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"fmt"
+	"github.com/selvinnsikt/backend/model"
+	"log"
+	"sync/atomic"
+)
+
+// What happens when a client is too slow and the queue of messages to it is full
+const (
+	// Close the connection with model.CLOSE_SLOW_CLIENT
+	SlowDisconnect = "disconnect"
+	// Drop non-critical messages, disconnect on critical messages
+	SlowDrop = "drop"
+	// Replace queued messages that only hold the latest state with the newer
+	// one, otherwise like SlowDrop
+	SlowCoalesce = "coalesce"
+)
+
+// defaultSendQueueSize is how many messages can wait to be sent to one client
+const defaultSendQueueSize = 64
+
+// nonCritical messages can be lost without the client missing anything,
+// since a later message tells the same. Acks of what a player sent are never
+// dropped, or the phone would show the vote as not sent
+var nonCritical = map[string]bool{
+	model.PHASE_TIMER:      true,
+	model.DISPLAY_PROGRESS: true,
+	model.LOBBY_ROSTER:     true,
+	model.LATENCY:          true,
+}
+
+// coalescable messages hold the whole state, so only the newest one matters
+var coalescable = map[string]bool{
+	model.PHASE_TIMER:      true,
+	model.DISPLAY_PROGRESS: true,
+	model.LOBBY_ROSTER:     true,
+	model.LATENCY:          true,
+}
+
+// slowCounters counts what happened to slow clients since the server started
+type slowCounters struct {
+	dropped      int64
+	coalesced    int64
+	disconnected int64
+}
+
+// payloadName returns the payload type of the message, empty if it has none
+func payloadName(msg interface{}) string {
+	if p, ok := msg.(interface{ PayloadName() string }); ok {
+		return p.PayloadName()
+	}
+	return ""
+}
+
+// overflow applies the slow client policy to a message that does not fit in
+// the queue. Must be called with the mutex locked
+func (w *writer) overflow(msg interface{}) {
+	config := w.hub.registry.config
+	counters := &w.hub.registry.slow
+	t := payloadName(msg)
+
+	if config.SlowClientPolicy == SlowCoalesce && coalescable[t] {
+		for i, o := range w.pending {
+			if payloadName(o.msg) == t {
+				// The newer message takes the place at the end of the queue
+				w.pending = append(append(w.pending[:i:i], w.pending[i+1:]...), outgoing{msg: msg})
+				atomic.AddInt64(&counters.coalesced, 1)
+				log.Printf("coalesced '%s' to slow client '%s' in hub '%s'\n", t, w.name, w.hub.hubID)
+				return
+			}
+		}
+	}
+	if config.SlowClientPolicy != SlowDisconnect && nonCritical[t] {
+		atomic.AddInt64(&counters.dropped, 1)
+		log.Printf("dropped '%s' to slow client '%s' in hub '%s'\n", t, w.name, w.hub.hubID)
+		return
+	}
+
+	// The messages still waiting are thrown away, the client gets the state
+	// of the game when rejoining
+	atomic.AddInt64(&counters.disconnected, 1)
+	log.Printf("disconnecting slow client '%s' in hub '%s', %d messages are waiting\n", w.name, w.hub.hubID, len(w.pending))
+	w.pending = []outgoing{{closeCode: model.CLOSE_SLOW_CLIENT, reason: "too slow to keep up with the messages"}}
+	w.closing = true
+}
+
+// Validate fills in the defaults and checks the hub IDs, the slow client
+// policy and the ping settings
+func (c *Config) Validate() error {
+	if c.Code.Style == "" {
+		c.Code = DefaultCodeConfig()
+	}
+	if err := c.Code.Validate(); err != nil {
+		return err
+	}
+	if c.SendQueueSize == 0 {
+		c.SendQueueSize = defaultSendQueueSize
+	}
+	if c.SendQueueSize < 1 {
+		return fmt.Errorf("the send queue size must be at least 1, got %d", c.SendQueueSize)
+	}
+	switch c.SlowClientPolicy {
+	case "":
+		c.SlowClientPolicy = SlowCoalesce
+	case SlowDisconnect, SlowDrop, SlowCoalesce:
+	default:
+		return fmt.Errorf("'%s' is not a slow client policy, must be '%s', '%s' or '%s'", c.SlowClientPolicy, SlowDisconnect, SlowDrop, SlowCoalesce)
+	}
+	if c.PingInterval > 0 && c.PongWait <= c.PingInterval {
+		return fmt.Errorf("the pong wait must be longer than the ping interval")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package hub
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/selvinnsikt/backend/model"
+	"log"
+	"strings"
+)
+
+// ValidateViewer checks that the hub exists. Spectators and displays can
+// attach at any time, also while the lobby is locked
+func ValidateViewer(hubID string) (*Hub, error) {
+	return getHub(hubID)
+}
+
+// isViewerID returns true if the name looks like the ID of a viewer, e.g.
+// 'spectator-1' or 'display-2'
+func isViewerID(name string) bool {
+	return strings.HasPrefix(name, model.ROLE_SPECTATOR+"-") || strings.HasPrefix(name, model.ROLE_DISPLAY+"-")
+}
+
+// AddViewerToHub attaches a connection that gets broadcasts but can not
+// play, with the role model.ROLE_SPECTATOR or model.ROLE_DISPLAY. The viewer
+// gets an ID instead of a player name
+func (h *Hub) AddViewerToHub(conn *websocket.Conn, role string) {
+	h.mutex.Lock()
+	if h.isClosed() {
+		h.mutex.Unlock()
+		rejectConn(conn, ErrHubClosed.Error())
+		return
+	}
+	h.viewersAdded++
+	id := fmt.Sprintf("%s-%d", role, h.viewersAdded)
+	log.Printf("adding '%s' to hub '%s' with IP '%s'\n", id, h.hubID, conn.RemoteAddr().String())
+	c := Client{
+		Conn:   conn,
+		writer: newWriter(conn, h, id),
+		role:   role,
+	}
+	h.viewers[id] = c
+	c.send(model.ConnSuccess{
+		PayloadType: model.PayloadType{Type: model.CONNECTION_SUCCESS},
+		Player:      id,
+		Role:        role,
+	})
+	h.mutex.Unlock()
+
+	go h.readMessageFromViewer(&model.PlayerConnection{Name: id, Conn: conn}, c.writer)
+}
+
+// readMessageFromViewer tells the game when the viewer attaches and leaves.
+// Messages from the viewer are answered with an error
+func (h *Hub) readMessageFromViewer(pc *model.PlayerConnection, w *writer) {
+	defer w.halt()
+	if !h.sendToGame(model.Message{Player: pc.Name, Event: model.VIEWER_JOINED}) {
+		pc.Conn.Close()
+		return
+	}
+	stopHeartbeat := h.heartbeat(pc)
+	defer stopHeartbeat()
+	for {
+		_, _, err := pc.Conn.ReadMessage()
+		if err != nil {
+			// Every client is gone when the hub is closed
+			select {
+			case <-h.done:
+				return
+			default:
+			}
+			if h.removeViewer(pc) {
+				h.sendToGame(model.Message{Player: pc.Name, Event: model.VIEWER_LEFT})
+			}
+			return
+		}
+		h.SendMsgToViewer(model.Error{
+			PayloadType: model.PayloadType{Type: model.ERROR},
+			Code:        model.ERR_SPECTATOR,
+			Message:     "spectators and displays can not play",
+		}, pc.Name)
+	}
+}
+
+// removeViewer removes the viewer if the connection still belongs to it,
+// returns false if it was already removed
+func (h *Hub) removeViewer(pc *model.PlayerConnection) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	defer pc.Conn.Close()
+	if c, ok := h.viewers[pc.Name]; !ok || c.Conn != pc.Conn {
+		return false
+	}
+	log.Printf("deleting '%s' from hub '%s'\n", pc.Name, h.hubID)
+	delete(h.viewers, pc.Name)
+	return true
+}
+
+// SendMsgToViewer sends the message to one spectator or display
+func (h *Hub) SendMsgToViewer(msg interface{}, id string) {
+	h.mutex.RLock()
+	c, ok := h.viewers[id]
+	h.mutex.RUnlock()
+	if !ok {
+		log.Printf("did not find any viewer in hub '%s' with ID '%s'\n", h.hubID, id)
+		return
+	}
+	c.send(msg)
+}
+
+// NumberOfViewers returns how many viewers with the role are watching the hub
+func (h *Hub) NumberOfViewers(role string) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	var n int
+	for _, c := range h.viewers {
+		if c.role == role {
+			n++
+		}
+	}
+	return n
+}
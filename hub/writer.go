@@ -0,0 +1,146 @@
+package hub
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
+)
+
+// outgoing is a message waiting to be sent. A close code closes the
+// connection after the message
+type outgoing struct {
+	msg       interface{}
+	closeCode int
+	reason    string
+}
+
+// writer is the only one writing messages to a connection, so the client gets
+// them in the order they were queued
+type writer struct {
+	conn *websocket.Conn
+	// Hub and name of the client, used when the client is too slow
+	hub  *Hub
+	name string
+	// Messages waiting to be sent, at most SendQueueSize
+	pending []outgoing
+	// Signals run() that there is something to do
+	wake  chan struct{}
+	mutex *sync.Mutex
+	// Nothing more is queued once the writer is halted or the connection is closing
+	halted  bool
+	closing bool
+}
+
+// newWriter starts sending the messages queued for the connection
+func newWriter(conn *websocket.Conn, h *Hub, name string) *writer {
+	w := makeWriter(conn, h, name)
+	go w.run()
+	return w
+}
+
+func makeWriter(conn *websocket.Conn, h *Hub, name string) *writer {
+	return &writer{
+		conn:  conn,
+		hub:   h,
+		name:  name,
+		wake:  make(chan struct{}, 1),
+		mutex: new(sync.Mutex),
+	}
+}
+
+// run writes the queued messages until the writer is halted. A connection
+// that can not be written to is closed, which makes its reader fail
+func (w *writer) run() {
+	for range w.wake {
+		for {
+			w.mutex.Lock()
+			if len(w.pending) == 0 {
+				halted := w.halted
+				w.mutex.Unlock()
+				if halted {
+					return
+				}
+				break
+			}
+			o := w.pending[0]
+			w.pending = w.pending[1:]
+			w.mutex.Unlock()
+
+			if !w.write(o) {
+				w.conn.Close()
+				w.mutex.Lock()
+				w.pending = nil
+				w.closing = true
+				w.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// write sends the message, and the close frame if the message has a close
+// code. Returns false when the connection should be closed
+func (w *writer) write(o outgoing) bool {
+	if o.msg != nil {
+		w.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := w.conn.WriteJSON(o.msg); err != nil {
+			log.Printf("unable to send message to IP '%s' - %s\n", w.conn.RemoteAddr().String(), err.Error())
+			return false
+		}
+	}
+	if o.closeCode != 0 {
+		w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(o.closeCode, o.reason), time.Now().Add(writeWait))
+		return false
+	}
+	return true
+}
+
+// send queues the message without waiting. When the queue is full the
+// slow client policy of the hub decides what happens. Messages to a halted
+// writer are thrown away
+func (w *writer) send(msg interface{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.halted || w.closing {
+		return
+	}
+	if len(w.pending) >= w.hub.registry.config.SendQueueSize {
+		w.overflow(msg)
+	} else {
+		w.pending = append(w.pending, outgoing{msg: msg})
+	}
+	w.signal()
+}
+
+// close queues the message followed by a close frame with the code. Nothing
+// can be queued after it
+func (w *writer) close(msg interface{}, code int, reason string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.halted || w.closing {
+		w.conn.Close()
+		return
+	}
+	w.closing = true
+	w.pending = append(w.pending, outgoing{msg: msg, closeCode: code, reason: reason})
+	w.signal()
+}
+
+// signal wakes run() up without waiting. Must be called with the mutex locked
+func (w *writer) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// halt stops the writer once the queued messages are sent. Called when the
+// connection is not read anymore
+func (w *writer) halt() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.halted {
+		w.halted = true
+		close(w.wake)
+	}
+}
@@ -3,21 +3,57 @@ package main
 import (
 	"github.com/gorilla/mux"
 	"github.com/selvinnsikt/backend/controller"
+	"github.com/selvinnsikt/backend/database"
+	"github.com/selvinnsikt/backend/game"
 	"github.com/selvinnsikt/backend/hub"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func main() {
+	// Subcommands like 'import' and 'export' are run instead of the server
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	run()
 }
-func run(){
+func run() {
 	// Randomness
 	rand.Seed(time.Now().UnixNano())
 
-	hub.InitHubs()
+	// Database
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := hub.Config{
+		// How long players who lose the connection can rejoin
+		ReconnectGrace: getDuration("RECONNECT_GRACE", "30s"),
+		IdleTTL:        getDuration("HUB_IDLE_TTL", "30m"),
+		EmptyTTL:       getDuration("HUB_EMPTY_TTL", "5m"),
+		Code:           codeConfig(),
+		PingInterval:   getDuration("HUB_PING_INTERVAL", "25s"),
+		PongWait:       getDuration("HUB_PONG_WAIT", "60s"),
+		// What happens to clients that can not keep up with the messages
+		SlowClientPolicy: getEnv("HUB_SLOW_CLIENT_POLICY", hub.SlowCoalesce),
+	}
+	if q := getEnv("HUB_SEND_QUEUE", ""); q != "" {
+		if config.SendQueueSize, err = strconv.Atoi(q); err != nil {
+			log.Fatal("HUB_SEND_QUEUE must be a number - " + err.Error())
+		}
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	hub.InitHubs(config)
+	game.InitGames(db)
+	controller.InitController(db, getEnv("ADMIN_TOKEN", ""))
 
 	log.Println("starting up server")
 	log.Fatal(server())
@@ -28,7 +64,60 @@ func server() error {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/join/{hub}/{player}", controller.JoinRoomHandler)
-	r.HandleFunc("/create", controller.CreateHubHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/rejoin/{hub}/{player}", controller.RejoinRoomHandler)
+	r.HandleFunc("/spectate/{hub}", controller.SpectateHandler)
+	r.HandleFunc("/display/{hub}", controller.DisplayHandler)
+	r.HandleFunc("/create", controller.CreateHubHandler).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/packs", controller.QuestionOptionsHandler).Methods("GET", "OPTIONS")
+
+	// Managing the question bank, requires the admin token
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(controller.AdminAuth)
+	admin.HandleFunc("/questions", controller.ListQuestionsHandler).Methods("GET")
+	admin.HandleFunc("/questions", controller.CreateQuestionHandler).Methods("POST")
+	admin.HandleFunc("/questions/{id}", controller.GetQuestionHandler).Methods("GET")
+	admin.HandleFunc("/questions/{id}", controller.UpdateQuestionHandler).Methods("PUT")
+	admin.HandleFunc("/questions/{id}/deactivate", controller.DeactivateQuestionHandler).Methods("POST")
+	admin.HandleFunc("/questions/{id}/activate", controller.ActivateQuestionHandler).Methods("POST")
+	admin.HandleFunc("/questions/{id}/packs", controller.SetQuestionPacksHandler).Methods("PUT")
+	admin.HandleFunc("/packs", controller.CreatePackHandler).Methods("POST")
+	admin.HandleFunc("/packs/{slug}/import", controller.ImportPackHandler).Methods("POST")
+	admin.HandleFunc("/packs/{slug}/export", controller.ExportPackHandler).Methods("GET")
+	admin.HandleFunc("/hubs", controller.HubStatsHandler).Methods("GET")
 
 	return http.ListenAndServe(":8080", r)
 }
+
+// openDatabase connects to the database configured by the environment
+func openDatabase() (*database.SQLDatabase, error) {
+	return database.Open(getEnv("DATABASE_DRIVER", "sqlite3"), getEnv("DATABASE_DSN", "selvinnsikt.db"))
+}
+
+// getEnv returns the environment variable or the fallback if it is not set
+func getEnv(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// getDuration parses the environment variable as a duration like '30s'
+func getDuration(key, fallback string) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, fallback))
+	if err != nil {
+		log.Fatalf("%s must be a duration like '%s' - %s", key, fallback, err.Error())
+	}
+	return d
+}
+
+// codeConfig reads what the hub IDs should look like
+func codeConfig() hub.CodeConfig {
+	c := hub.CodeConfig{Style: getEnv("HUB_CODE_STYLE", hub.CodeDigits)}
+	if l := getEnv("HUB_CODE_LENGTH", ""); l != "" {
+		var err error
+		if c.Length, err = strconv.Atoi(l); err != nil {
+			log.Fatal("HUB_CODE_LENGTH must be a number - " + err.Error())
+		}
+	}
+	return c
+}
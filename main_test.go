@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/selvinnsikt/backend/controller"
+	"github.com/selvinnsikt/backend/database"
+	"github.com/selvinnsikt/backend/game"
 	"github.com/selvinnsikt/backend/model"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,6 +24,15 @@ import (
 
 func TestMain(m *testing.M) {
 	go func() {
+		// Wait for the server to start listening
+		for i := 0; i < 100; i++ {
+			conn, err := net.Dial("tcp", "localhost:8080")
+			if err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
 		exitCode := m.Run()
 		for _, p := range players {
 			err := p.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
@@ -28,10 +44,18 @@ func TestMain(m *testing.M) {
 		os.Exit(exitCode)
 	}()
 
+	// Use a fresh database for every test run
+	os.Setenv("DATABASE_DSN", ":memory:")
+	os.Setenv("ADMIN_TOKEN", adminToken)
+	os.Setenv("RECONNECT_GRACE", "1s")
+	os.Setenv("HUB_EMPTY_TTL", "2s")
+
 	// Start the server
 	run()
 }
 
+const adminToken = "test-admin-token"
+
 var seqMutex sync.Mutex
 
 // Ensures that these tests are run sequentially
@@ -84,20 +108,25 @@ func TestCreateAndJoinHub(t *testing.T) {
 }
 
 func joinHub(id, playerName string) (*websocket.Conn, error) {
-	u := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/join/" + id + "/" + playerName}
+	conn, _, err := dialHub(url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/join/" + id + "/" + playerName})
+	return conn, err
+}
+
+// dialHub connects and returns the connection success message from server
+func dialHub(u url.URL) (*websocket.Conn, model.ConnSuccess, error) {
+	var successMsg model.ConnSuccess
 	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
-		return nil, err
+		return nil, successMsg, err
 	}
 
 	// Read the connection success message from server
-	var successMsg model.ConnSuccess
 	err = conn.ReadJSON(&successMsg)
 	if err != nil {
-		return nil, err
+		return nil, successMsg, err
 	}
 
-	return conn, nil
+	return conn, successMsg, nil
 }
 
 func TestReadyToPlay(t *testing.T) {
@@ -133,7 +162,7 @@ func readFromConn(player Connection, t *testing.T, wg *sync.WaitGroup) {
 	var msgReceive model.ReadyToPlay
 
 	for {
-		err := player.Conn.ReadJSON(&msgReceive)
+		err := readJSON(player.Conn, &msgReceive)
 		if err != nil {
 			t.Errorf("FAIL - unable to read message from server - %s \n", err.Error())
 		}
@@ -166,7 +195,7 @@ func TestReceivingQuestions(t *testing.T) {
 		go func(num int, player Connection) {
 			var receiveMsg model.Questions
 			for {
-				err := player.Conn.ReadJSON(&receiveMsg)
+				err := readJSON(player.Conn, &receiveMsg)
 				if err != nil {
 					t.Errorf("FAIL - error reading json-object from server - %s", err.Error())
 				}
@@ -195,7 +224,7 @@ func TestAnswerToQuestions(t *testing.T) {
 			for {
 				// Starting to read
 				var msgRes model.PlayersVotesToQuestionReceived
-				err := p.Conn.ReadJSON(&msgRes)
+				err := readJSON(p.Conn, &msgRes)
 				if err != nil {
 					t.Errorf("ERROR - unable to read msg from server - %s", err.Error())
 				}
@@ -233,7 +262,7 @@ func TestAnswerToQuestions(t *testing.T) {
 	wgVotesToQuestions.Wait()
 	for _, p := range players {
 		var msgRec model.PayloadType
-		err := p.Conn.ReadJSON(&msgRec)
+		err := readJSON(p.Conn, &msgRec)
 		if err != nil {
 			t.Errorf("ERROR -  unable to read msg from server - %s", err.Error())
 		}
@@ -264,7 +293,7 @@ func TestSelfVoteOnQuestion(t *testing.T) {
 
 				// if statement works only for two players
 				if i%3 == 0 {
-					err := p.Conn.ReadJSON(&msgDone)
+					err := readJSON(p.Conn, &msgDone)
 					if err != nil {
 						t.Errorf("ERROR -  unable to read msg from server - %s", err.Error())
 					}
@@ -273,7 +302,7 @@ func TestSelfVoteOnQuestion(t *testing.T) {
 					}
 					fmt.Println(msgDone)
 				} else {
-					err := p.Conn.ReadJSON(&msgRec)
+					err := readJSON(p.Conn, &msgRec)
 					if err != nil {
 						t.Errorf("ERROR -  unable to read msg from server - %s", err.Error())
 					}
@@ -303,3 +332,1828 @@ func TestSelfVoteOnQuestion(t *testing.T) {
 	}
 	wgWaitForRead.Wait()
 }
+
+func TestGameFinished(t *testing.T) {
+	defer seq()()
+
+	// aksel got every vote and both players guessed mostVotes on all four questions
+	for _, p := range players {
+		b, err := readUntil(p.Conn, model.GAME_FINISHED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m model.GameFinished
+		json.Unmarshal(b, &m)
+
+		want := []model.Standing{
+			{Rank: 1, Player: "aksel", Points: 4 * model.POINTS_MAX},
+			{Rank: 2, Player: "alf", Points: 0},
+		}
+		if len(m.Standings) != len(want) {
+			t.Fatalf("FAIL - expected standings %v, got %v", want, m.Standings)
+		}
+		for i := range want {
+			if m.Standings[i] != want[i] {
+				t.Errorf("FAIL - expected standing %v, got %v", want[i], m.Standings[i])
+			}
+		}
+		if m.Tie || len(m.Winners) != 1 || m.Winners[0] != "aksel" {
+			t.Errorf("FAIL - expected aksel to win alone, got winners %v and tie %t", m.Winners, m.Tie)
+		}
+		if len(m.Questions) != model.MAX_NUMBER_OF_ROUND {
+			t.Fatalf("FAIL - expected %d questions, got %d", model.MAX_NUMBER_OF_ROUND, len(m.Questions))
+		}
+		for i, q := range m.Questions {
+			if q.Question != i+1 || q.Text == "" {
+				t.Errorf("FAIL - invalid question %d in results: %+v", i+1, q)
+			}
+			if q.Votes["aksel"] != 2*len(players) || q.Decisions["alf"] != model.MOST_VOTES || q.Points["aksel"] != model.POINTS_MAX {
+				t.Errorf("FAIL - invalid breakdown of question %d: %+v", i+1, q)
+			}
+		}
+	}
+}
+
+func TestConcurrentHubs(t *testing.T) {
+	defer seq()()
+
+	const numberOfHubs = 5
+	names := []string{"ola", "kari"}
+
+	wg := sync.WaitGroup{}
+	hubIDs := make([]string, numberOfHubs)
+	for i := 0; i < numberOfHubs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hubID, err := createHub()
+			if err != nil {
+				t.Errorf("FAIL - unable to create hub - %s", err.Error())
+				return
+			}
+			hubIDs[i] = hubID
+
+			// Every hub uses the same player names
+			var conns []*websocket.Conn
+			for _, n := range names {
+				conn, err := joinHub(hubID, n)
+				if err != nil {
+					t.Errorf("FAIL - unable to join hub '%s' - %s", hubID, err.Error())
+					return
+				}
+				defer conn.Close()
+				conns = append(conns, conn)
+			}
+
+			for _, c := range conns {
+				err := c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+				if err != nil {
+					t.Errorf("FAIL - unable to send ready msg to hub '%s' - %s", hubID, err.Error())
+					return
+				}
+			}
+			for _, c := range conns {
+				err := expectMessages(c, map[string]int{model.READY_TO_PLAY: len(names), model.FOUR_QUESTIONS: 1})
+				if err != nil {
+					t.Errorf("FAIL - hub '%s' - %s", hubID, err.Error())
+					return
+				}
+			}
+
+			for q := 1; q <= model.MAX_NUMBER_OF_ROUND; q++ {
+				for _, c := range conns {
+					err := c.WriteJSON(model.PlayersVotesToQuestion{
+						PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+						Question:    q,
+						Votes:       map[string]int{names[0]: 2},
+					})
+					if err != nil {
+						t.Errorf("FAIL - unable to send vote to hub '%s' - %s", hubID, err.Error())
+						return
+					}
+				}
+			}
+			for _, c := range conns {
+				err := expectMessages(c, map[string]int{
+					model.PLAYERS_VOTE_TO_QUESTION_RECIEVED: len(names) * model.MAX_NUMBER_OF_ROUND,
+					model.PLAYERS_VOTE_TO_QUESTION_DONE:     1,
+				})
+				if err != nil {
+					t.Errorf("FAIL - hub '%s' - %s", hubID, err.Error())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every hub must own its own game
+	seen := make(map[*game.Game]bool)
+	for _, id := range hubIDs {
+		g, err := game.GetGame(id)
+		if err != nil {
+			t.Errorf("FAIL - %s", err.Error())
+			continue
+		}
+		if g.Hub.HubID() != id {
+			t.Errorf("FAIL - expected game for hub '%s', got game for hub '%s'", id, g.Hub.HubID())
+		}
+		if seen[g] {
+			t.Errorf("FAIL - game for hub '%s' is shared with another hub", id)
+		}
+		seen[g] = true
+	}
+}
+
+func TestCreateHubWithPack(t *testing.T) {
+	defer seq()()
+
+	// Unknown packs and languages are rejected
+	for _, q := range []string{"pack=does-not-exist", "language=xx"} {
+		res, err := http.Get("http://localhost:8080/create?" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("FAIL - expected status code %d for '%s', got %d", http.StatusBadRequest, q, res.StatusCode)
+		}
+	}
+
+	hubID, err := createHubWithQuery("language=en&pack=work-team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := joinHub(hubID, "ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The only english work team questions
+	want := map[string]bool{
+		"Who is most likely to answer emails on vacation?": true,
+		"Who has the tidiest desk?":                        true,
+		"Who is most likely to suggest another meeting?":   true,
+		"Who would do best as CEO?":                        true,
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var q model.Questions
+		if err := readJSON(conn, &q); err != nil {
+			t.Fatal(err)
+		}
+		if q.Type != model.FOUR_QUESTIONS {
+			continue
+		}
+		for _, text := range q.Question {
+			if !want[text] {
+				t.Errorf("FAIL - '%s' is not an english work team question", text)
+			}
+		}
+		break
+	}
+}
+
+// skippedTypes are broadcasts that readJSON skips
+var skippedTypes = map[string]bool{
+	model.LOBBY_ROSTER: true,
+	model.PHASE_TIMER:  true,
+}
+
+// readJSON reads the next message that is not of a skipped type into v
+func readJSON(conn *websocket.Conn, v interface{}) error {
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var p model.PayloadType
+		if json.Unmarshal(b, &p) == nil && skippedTypes[p.Type] {
+			continue
+		}
+		return json.Unmarshal(b, v)
+	}
+}
+
+// readUntil reads until it gets a message of the payload type and returns it
+func readUntil(conn *websocket.Conn, payloadType string) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("still waiting for %s - %s", payloadType, err.Error())
+		}
+		var p model.PayloadType
+		if json.Unmarshal(b, &p) == nil && p.Type == payloadType {
+			return b, nil
+		}
+	}
+}
+
+func createHub() (string, error) {
+	return createHubWithQuery("")
+}
+
+func createHubWithQuery(query string) (string, error) {
+	res, err := http.Get("http://localhost:8080/create?" + query)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("expected status code %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	var hubID model.HubID
+	err = json.NewDecoder(res.Body).Decode(&hubID)
+	if err != nil {
+		return "", err
+	}
+	return hubID.Hub, nil
+}
+
+// expectMessages reads from the connection until the given number of messages
+// of every payload type is received. Messages of other types are skipped
+func expectMessages(conn *websocket.Conn, want map[string]int) error {
+	remaining := 0
+	for _, n := range want {
+		remaining += n
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for remaining > 0 {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("still waiting for %v - %s", want, err.Error())
+		}
+		var p model.PayloadType
+		if err := json.Unmarshal(b, &p); err != nil {
+			continue
+		}
+		if want[p.Type] > 0 {
+			want[p.Type]--
+			remaining--
+		}
+	}
+	return nil
+}
+
+func TestAdminQuestions(t *testing.T) {
+	defer seq()()
+
+	// Requests without the token are rejected
+	res, err := adminRequest("GET", "/admin/questions", "wrong-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("FAIL - expected status code %d, got %d", http.StatusUnauthorized, res.StatusCode)
+	}
+
+	// The token must be sent with the Bearer scheme
+	req, err := http.NewRequest("GET", "http://localhost:8080/admin/questions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", adminToken)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("FAIL - expected status code %d without the Bearer scheme, got %d", http.StatusUnauthorized, res.StatusCode)
+	}
+
+	// Create a question
+	var created database.Question
+	res, err = adminRequest("POST", "/admin/questions", adminToken, database.Question{
+		Text:     "Who is most likely to win a quiz?",
+		Language: "en",
+		Category: "general",
+		Packs:    []string{"old-friends"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("FAIL - expected status code %d, got %d", http.StatusCreated, res.StatusCode)
+	}
+	json.NewDecoder(res.Body).Decode(&created)
+	if !created.Active || created.ID == 0 || len(created.Packs) != 1 {
+		t.Errorf("FAIL - unexpected question %+v", created)
+	}
+
+	// Invalid questions are rejected
+	tests := []struct {
+		q      database.Question
+		status int
+	}{
+		{database.Question{Text: "  who is MOST likely to win a   quiz? ", Language: "en"}, http.StatusConflict},
+		{database.Question{Text: strings.Repeat("a", database.MaxQuestionLength+1), Language: "en"}, http.StatusBadRequest},
+		{database.Question{Text: "Who?", Language: "xx"}, http.StatusBadRequest},
+		{database.Question{Text: "Who?", Language: "en", Packs: []string{"does-not-exist"}}, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		res, err := adminRequest("POST", "/admin/questions", adminToken, tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("FAIL - expected status code %d for '%s', got %d", tc.status, tc.q.Text, res.StatusCode)
+		}
+	}
+
+	// Update and deactivate the question
+	id := strconv.FormatInt(created.ID, 10)
+	res, err = adminRequest("PUT", "/admin/questions/"+id, adminToken, database.Question{Text: "Who is most likely to win a pub quiz?", Language: "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("FAIL - expected status code %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	res, err = adminRequest("POST", "/admin/questions/"+id+"/deactivate", adminToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q database.Question
+	json.NewDecoder(res.Body).Decode(&q)
+	if q.Active || q.Text != "Who is most likely to win a pub quiz?" {
+		t.Errorf("FAIL - expected an updated inactive question, got %+v", q)
+	}
+
+	// Tag the question with packs
+	res, err = adminRequest("PUT", "/admin/questions/"+id+"/packs", adminToken, map[string][]string{"packs": {"work-team", "family-friendly"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(res.Body).Decode(&q)
+	if len(q.Packs) != 2 {
+		t.Errorf("FAIL - expected two packs, got %v", q.Packs)
+	}
+
+	// Paginate the inactive english questions
+	res, err = adminRequest("GET", "/admin/questions?language=en&active=false&perPage=1", adminToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page controller.QuestionPage
+	json.NewDecoder(res.Body).Decode(&page)
+	if page.Total != 1 || len(page.Questions) != 1 || page.Questions[0].ID != created.ID {
+		t.Errorf("FAIL - expected only question %d, got %+v", created.ID, page)
+	}
+	res, err = adminRequest("GET", "/admin/questions?perPage=1000", adminToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("FAIL - expected status code %d, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func adminRequest(method, path, token string, body interface{}) (*http.Response, error) {
+	var b bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&b).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, "http://localhost:8080"+path, &b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+func TestImportAndExportPack(t *testing.T) {
+	defer seq()()
+
+	csvFile := "text,language,category\n" +
+		"Who is the best cook?,en,general\n" +
+		",en,\n" +
+		"Who is the best cook?,en,\n" +
+		"Who is most likely to be late?,en,general\n" +
+		"Hvem lager best mat?,no,does-not-exist\n"
+
+	importPack := func(query string) database.ImportReport {
+		req, err := http.NewRequest("POST", "http://localhost:8080/admin/packs/party/import?"+query, strings.NewReader(csvFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("Content-Type", "text/csv")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("FAIL - expected status code %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		var report database.ImportReport
+		json.NewDecoder(res.Body).Decode(&report)
+		return report
+	}
+
+	// Nothing is stored on a dry-run
+	report := importPack("dryRun=true&name=Party")
+	if report.Created != 1 || report.Existing != 1 || len(report.Errors) != 3 {
+		t.Errorf("FAIL - unexpected report %+v", report)
+	}
+	for i, row := range []int{3, 4, 6} {
+		if i < len(report.Errors) && report.Errors[i].Row != row {
+			t.Errorf("FAIL - expected error on row %d, got row %d", row, report.Errors[i].Row)
+		}
+	}
+	res, err := adminRequest("GET", "/admin/packs/party/export", adminToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("FAIL - expected status code %d after dry-run, got %d", http.StatusNotFound, res.StatusCode)
+	}
+
+	importPack("name=Party")
+
+	// Importing the same file again only finds existing questions
+	report = importPack("")
+	if report.Created != 0 || report.Existing != 2 {
+		t.Errorf("FAIL - unexpected report after importing twice %+v", report)
+	}
+
+	res, err = adminRequest("GET", "/admin/packs/party/export?format=csv", adminToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	want := "text,language,category\n" +
+		"Who is most likely to be late?,en,general\n" +
+		"Who is the best cook?,en,general\n"
+	if string(b) != want {
+		t.Errorf("FAIL - expected export\n%s\ngot\n%s", want, string(b))
+	}
+
+	// Files over 10 MB are rejected
+	large := csvFile + strings.Repeat("x", 10<<20)
+	req, err := http.NewRequest("POST", "http://localhost:8080/admin/packs/party/import", strings.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Content-Type", "text/csv")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("FAIL - expected status code %d for a large file, got %d", http.StatusRequestEntityTooLarge, res.StatusCode)
+	}
+}
+
+func TestMessageInWrongPhase(t *testing.T) {
+	defer seq()()
+
+	hubID, err := createHub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := joinHub(hubID, "ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Self-voting before the game has started used to crash the server
+	err = conn.WriteJSON(model.SelfVoteOnQuestion{
+		PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION},
+		Question:    1,
+		Decision:    model.MOST_VOTES,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e model.Error
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := readJSON(conn, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != model.ERROR || e.Code != model.ERR_WRONG_PHASE || e.Phase != string(game.Lobby) || e.RejectedType != model.SELF_VOTE_ON_QUESTION {
+		t.Errorf("FAIL - expected a %s error in phase %s, got %+v", model.ERR_WRONG_PHASE, game.Lobby, e)
+	}
+
+	g, err := game.GetGame(hubID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Phase() != game.Lobby {
+		t.Errorf("FAIL - expected phase %s, got %s", game.Lobby, g.Phase())
+	}
+}
+
+func TestLobbyRoster(t *testing.T) {
+	defer seq()()
+
+	hubID, err := createHub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := game.GetGame(hubID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ola, err := joinHub(hubID, "ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	kari, err := joinHub(hubID, "kari")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kari.Close()
+
+	// sendTwice sends the ready state twice and waits until the game has handled it
+	sendTwice := func(conn *websocket.Conn, ready bool) {
+		for i := 0; i < 2; i++ {
+			err := conn.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: ready})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := conn.WriteJSON(model.PayloadType{Type: model.PLAYERS_CONNECTED}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readUntil(conn, model.PLAYERS_CONNECTED); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Being ready twice only counts once
+	sendTwice(kari, true)
+	if n := g.NumberPlayersReady(); n != 1 {
+		t.Errorf("FAIL - expected 1 player ready, got %d", n)
+	}
+
+	// Not ready can not make the count negative
+	sendTwice(ola, false)
+	if n := g.NumberPlayersReady(); n != 1 {
+		t.Errorf("FAIL - expected 1 player ready, got %d", n)
+	}
+
+	// The host leaves, the game starts since everyone left is ready
+	ola.Close()
+	for {
+		b, err := readUntil(kari, model.LOBBY_ROSTER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var roster model.LobbyRoster
+		json.Unmarshal(b, &roster)
+		if len(roster.Players) == 1 {
+			if roster.Host != "kari" || !roster.Players[0].Host || !roster.Players[0].Ready || roster.NumberReady != 1 {
+				t.Errorf("FAIL - expected kari to be the ready host, got %+v", roster)
+			}
+			break
+		}
+	}
+	if _, err := readUntil(kari, model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+	if g.Phase() != game.Voting {
+		t.Errorf("FAIL - expected phase %s, got %s", game.Voting, g.Phase())
+	}
+}
+
+func TestCreateHubWithSettings(t *testing.T) {
+	defer seq()()
+
+	postSettings := func(body string) (*http.Response, error) {
+		return http.Post("http://localhost:8080/create", "application/json", strings.NewReader(body))
+	}
+
+	// Invalid settings are rejected
+	for _, body := range []string{
+		`{"game": {"numberOfQuestions": 0}}`,
+		`{"game": {"votesPerQuestion": 11}}`,
+		`{"game": {"points": {"max": 1, "neutral": 2, "zero": 0}}}`,
+		`{"game": {"minPlayers": 0}}`,
+		`{"game": {"minPlayers": 1, "allowSelfVote": false}}`,
+	} {
+		res, err := postSettings(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("FAIL - expected status code %d for '%s', got %d", http.StatusBadRequest, body, res.StatusCode)
+		}
+	}
+
+	res, err := postSettings(`{"language": "en", "game": {"numberOfQuestions": 2, "votesPerQuestion": 3,
+		"points": {"max": 5, "neutral": 2, "zero": 1}, "minPlayers": 2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+	g, err := game.GetGame(hubID.Hub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ola, err := joinHub(hubID.Hub, "ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	ready := model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true}
+
+	// One player is not enough to start
+	ola.WriteJSON(ready)
+	ola.WriteJSON(model.PayloadType{Type: model.PLAYERS_CONNECTED})
+	if _, err := readUntil(ola, model.PLAYERS_CONNECTED); err != nil {
+		t.Fatal(err)
+	}
+	if g.Phase() != game.Lobby {
+		t.Errorf("FAIL - expected phase %s with one player, got %s", game.Lobby, g.Phase())
+	}
+
+	kari, err := joinHub(hubID.Hub, "kari")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kari.Close()
+	kari.WriteJSON(ready)
+
+	conns := []*websocket.Conn{ola, kari}
+	for _, c := range conns {
+		b, err := readUntil(c, model.FOUR_QUESTIONS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q model.Questions
+		json.Unmarshal(b, &q)
+		if len(q.Question) != 2 {
+			t.Errorf("FAIL - expected 2 questions, got %d", len(q.Question))
+		}
+	}
+
+	// Question 3 does not exist and every vote must be used
+	invalid := []model.PlayersVotesToQuestion{
+		{Question: 3, Votes: map[string]int{"ola": 3}},
+		{Question: 1, Votes: map[string]int{"ola": 2}},
+	}
+	for i, code := range []string{model.ERR_INVALID_QUESTION, model.ERR_INVALID_VOTES} {
+		invalid[i].Type = model.PLAYERS_VOTE_TO_QUESTION
+		ola.WriteJSON(invalid[i])
+		b, err := readUntil(ola, model.ERROR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e model.Error
+		json.Unmarshal(b, &e)
+		if e.Code != code {
+			t.Errorf("FAIL - expected error %s, got %+v", code, e)
+		}
+	}
+
+	// ola gets 4 votes and kari gets 2 on both questions
+	for q := 1; q <= 2; q++ {
+		for _, c := range conns {
+			c.WriteJSON(model.PlayersVotesToQuestion{
+				PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+				Question:    q,
+				Votes:       map[string]int{"ola": 2, "kari": 1},
+			})
+		}
+	}
+	for _, c := range conns {
+		if _, err := readUntil(c, model.PLAYERS_VOTE_TO_QUESTION_DONE); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decisions := []map[string]string{
+		{"ola": model.MOST_VOTES, "kari": model.LEAST_VOTES},
+		{"ola": model.NEUTRAL, "kari": model.MOST_VOTES},
+	}
+	want := []map[string]int{
+		{"ola": 5, "kari": 5},
+		{"ola": 1, "kari": 1},
+	}
+	for i, d := range decisions {
+		ola.WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: i + 1, Decision: d["ola"]})
+		kari.WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: i + 1, Decision: d["kari"]})
+		b, err := readUntil(ola, model.SELF_VOTE_ON_QUESTION_DONE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var done model.SelfVoteOnQuestionDone
+		json.Unmarshal(b, &done)
+		for p, points := range want[i] {
+			if done.Points[p] != points {
+				t.Errorf("FAIL - question %d expected %d points for %s, got %d", i+1, points, p, done.Points[p])
+			}
+		}
+	}
+
+	// Both players end up with 6 points and share the first place
+	b, err := readUntil(kari, model.GAME_FINISHED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var finished model.GameFinished
+	json.Unmarshal(b, &finished)
+	if !finished.Tie || len(finished.Winners) != 2 {
+		t.Errorf("FAIL - expected a tie between two winners, got %v", finished.Winners)
+	}
+	for _, s := range finished.Standings {
+		if s.Rank != 1 || s.Points != 6 {
+			t.Errorf("FAIL - expected rank 1 with 6 points, got %+v", s)
+		}
+	}
+	if g.Phase() != game.Results {
+		t.Errorf("FAIL - expected phase %s, got %s", game.Results, g.Phase())
+	}
+}
+
+func TestPlayAgain(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+	g, err := game.GetGame(hubID.Hub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := joinHub(hubID.Hub, "solo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Plays a game with one question where solo guesses right, returns the question
+	playGame := func(number int) string {
+		conn.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+		b, err := readUntil(conn, model.FOUR_QUESTIONS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q model.Questions
+		json.Unmarshal(b, &q)
+
+		conn.WriteJSON(model.PlayersVotesToQuestion{
+			PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+			Question:    1,
+			Votes:       map[string]int{"solo": 1},
+		})
+		if _, err := readUntil(conn, model.PLAYERS_VOTE_TO_QUESTION_DONE); err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteJSON(model.SelfVoteOnQuestion{
+			PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION},
+			Question:    1,
+			Decision:    model.MOST_VOTES,
+		})
+		b, err = readUntil(conn, model.GAME_FINISHED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var finished model.GameFinished
+		json.Unmarshal(b, &finished)
+		if finished.Game != number {
+			t.Errorf("FAIL - expected game %d, got %d", number, finished.Game)
+		}
+		// The score starts at zero in every game
+		if len(finished.Standings) != 1 || finished.Standings[0].Points != model.POINTS_MAX {
+			t.Errorf("FAIL - expected solo to get %d points in game %d, got %v", model.POINTS_MAX, number, finished.Standings)
+		}
+		return q.Question[0]
+	}
+
+	first := playGame(1)
+
+	conn.WriteJSON(model.PayloadType{Type: model.PLAY_AGAIN})
+	b, err := readUntil(conn, model.PLAY_AGAIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again model.PlayAgain
+	json.Unmarshal(b, &again)
+	if again.Player != "solo" || again.Game != 2 || len(again.History) != 1 || again.History[0].Winners[0] != "solo" {
+		t.Errorf("FAIL - invalid PlayAgain message: %+v", again)
+	}
+	if g.Phase() != game.Lobby || g.NumberPlayersReady() != 0 {
+		t.Errorf("FAIL - expected phase %s with nobody ready, got %s with %d ready", game.Lobby, g.Phase(), g.NumberPlayersReady())
+	}
+
+	// PlayAgain is only accepted after a game
+	conn.WriteJSON(model.PayloadType{Type: model.PLAY_AGAIN})
+	b, err = readUntil(conn, model.ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e model.Error
+	json.Unmarshal(b, &e)
+	if e.Code != model.ERR_WRONG_PHASE {
+		t.Errorf("FAIL - expected error %s, got %+v", model.ERR_WRONG_PHASE, e)
+	}
+
+	if second := playGame(2); second == first {
+		t.Errorf("FAIL - question '%s' was played twice", first)
+	}
+	if len(g.History()) != 1 {
+		t.Errorf("FAIL - expected one game in the history before the next PlayAgain, got %d", len(g.History()))
+	}
+}
+
+func TestRoundTimers(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1,
+			"minPlayers": 2, "votingSeconds": 2, "selfVotingSeconds": 1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	ola, err := joinHub(hubID.Hub, "ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	kari, err := joinHub(hubID.Hub, "kari")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kari.Close()
+	for _, c := range []*websocket.Conn{ola, kari} {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+
+	// The countdown starts when the voting starts
+	b, err := readUntil(ola, model.PHASE_TIMER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timer model.PhaseTimer
+	json.Unmarshal(b, &timer)
+	if timer.Phase != string(game.Voting) || timer.SecondsLeft < 1 || timer.SecondsLeft > 2 {
+		t.Errorf("FAIL - invalid timer: %+v", timer)
+	}
+
+	// kari never votes or self-votes
+	ola.WriteJSON(model.PlayersVotesToQuestion{
+		PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+		Question:    1,
+		Votes:       map[string]int{"ola": 1},
+	})
+	expectTimeUp := func(phase game.Phase) {
+		b, err := readUntil(ola, model.TIME_UP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m model.TimeUp
+		json.Unmarshal(b, &m)
+		if m.Phase != string(phase) || len(m.Missing) != 1 || m.Missing[0] != "kari" {
+			t.Errorf("FAIL - expected kari to miss phase %s, got %+v", phase, m)
+		}
+	}
+	expectTimeUp(game.Voting)
+	if _, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_DONE); err != nil {
+		t.Fatal(err)
+	}
+
+	ola.WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: 1, Decision: model.MOST_VOTES})
+	expectTimeUp(game.SelfVoting)
+	b, err = readUntil(ola, model.SELF_VOTE_ON_QUESTION_DONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var done model.SelfVoteOnQuestionDone
+	json.Unmarshal(b, &done)
+	if done.Points["ola"] != model.POINTS_MAX || done.Points["kari"] != model.POINTS_ZERO {
+		t.Errorf("FAIL - expected ola to get %d and kari %d points, got %v", model.POINTS_MAX, model.POINTS_ZERO, done.Points)
+	}
+	if _, err := readUntil(ola, model.GAME_FINISHED); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangeVote(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 2, "minPlayers": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	ola, err := joinHub(hubID.Hub, "ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	kari, err := joinHub(hubID.Hub, "kari")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kari.Close()
+	for _, c := range []*websocket.Conn{ola, kari} {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+	for _, c := range []*websocket.Conn{ola, kari} {
+		if _, err := readUntil(c, model.FOUR_QUESTIONS); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vote := func(c *websocket.Conn, payloadType string, question int, votes map[string]int) {
+		c.WriteJSON(model.PlayersVotesToQuestion{
+			PayloadType: model.PayloadType{Type: payloadType},
+			Question:    question,
+			Votes:       votes,
+		})
+	}
+	expectError := func(code string) {
+		b, err := readUntil(ola, model.ERROR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e model.Error
+		json.Unmarshal(b, &e)
+		if e.Code != code {
+			t.Errorf("FAIL - expected error %s, got %+v", code, e)
+		}
+	}
+
+	vote(ola, model.PLAYERS_VOTE_TO_QUESTION, 1, map[string]int{"ola": 2})
+	if _, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_RECIEVED); err != nil {
+		t.Fatal(err)
+	}
+
+	// Voting twice on the same question is rejected
+	vote(ola, model.PLAYERS_VOTE_TO_QUESTION, 1, map[string]int{"ola": 2})
+	expectError(model.ERR_ALREADY_VOTED)
+
+	// There is nothing to change before the player has voted
+	vote(ola, model.CHANGE_VOTE, 2, map[string]int{"kari": 2})
+	expectError(model.ERR_NOT_VOTED)
+
+	vote(ola, model.CHANGE_VOTE, 1, map[string]int{"kari": 2})
+	b, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_RECIEVED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received model.PlayersVotesToQuestionReceived
+	json.Unmarshal(b, &received)
+	if !received.Changed || received.Question != 1 || received.Player != "ola" {
+		t.Errorf("FAIL - expected a changed vote from ola on question 1, got %+v", received)
+	}
+
+	vote(kari, model.PLAYERS_VOTE_TO_QUESTION, 1, map[string]int{"kari": 2})
+	for _, c := range []*websocket.Conn{ola, kari} {
+		vote(c, model.PLAYERS_VOTE_TO_QUESTION, 2, map[string]int{"ola": 1, "kari": 1})
+	}
+	if _, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_DONE); err != nil {
+		t.Fatal(err)
+	}
+
+	for q := 1; q <= 2; q++ {
+		for _, c := range []*websocket.Conn{ola, kari} {
+			c.WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: q, Decision: model.NEUTRAL})
+		}
+	}
+	b, err = readUntil(ola, model.GAME_FINISHED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var finished model.GameFinished
+	json.Unmarshal(b, &finished)
+
+	// The votes ola first gave on question 1 are replaced
+	want := []map[string]int{
+		{"kari": 4},
+		{"ola": 2, "kari": 2},
+	}
+	for i, votes := range want {
+		got := finished.Questions[i].Votes
+		if len(got) != len(votes) {
+			t.Errorf("FAIL - expected votes %v on question %d, got %v", votes, i+1, got)
+			continue
+		}
+		for p, v := range votes {
+			if got[p] != v {
+				t.Errorf("FAIL - expected votes %v on question %d, got %v", votes, i+1, got)
+			}
+		}
+	}
+}
+
+func TestVoteTargets(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "minPlayers": 2, "allowSelfVote": false}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+	if hubID.Settings.Game.AllowSelfVote {
+		t.Errorf("FAIL - expected self votes to be turned off")
+	}
+
+	ola, err := joinHub(hubID.Hub, "ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	kari, err := joinHub(hubID.Hub, "kari")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kari.Close()
+	for _, c := range []*websocket.Conn{ola, kari} {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+	if _, err := readUntil(ola, model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+
+	// ghost is not in the hub and ola can not vote on herself
+	ola.WriteJSON(model.PlayersVotesToQuestion{
+		PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+		Question:    1,
+		Votes:       map[string]int{"ola": 1, "ghost": 1},
+	})
+	b, err := readUntil(ola, model.ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e model.Error
+	json.Unmarshal(b, &e)
+	if e.Code != model.ERR_INVALID_TARGETS || len(e.InvalidTargets) != 2 || e.InvalidTargets[0] != "ghost" || e.InvalidTargets[1] != "ola" {
+		t.Errorf("FAIL - expected error %s naming ghost and ola, got %+v", model.ERR_INVALID_TARGETS, e)
+	}
+
+	ola.WriteJSON(model.PlayersVotesToQuestion{
+		PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+		Question:    1,
+		Votes:       map[string]int{"kari": 2},
+	})
+	b, err = readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_RECIEVED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received model.PlayersVotesToQuestionReceived
+	json.Unmarshal(b, &received)
+	if received.Player != "ola" {
+		t.Errorf("FAIL - expected the vote from ola to be received, got %+v", received)
+	}
+}
+
+func TestPlayerLeavesMidGame(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1, "minPlayers": 3}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"ola", "kari", "per"} {
+		c, err := joinHub(hubID.Hub, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[name] = c
+	}
+	for _, c := range conns {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+	ola, kari := conns["ola"], conns["kari"]
+	if _, err := readUntil(ola, model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+
+	expectPlayerLeft := func(player string, phase game.Phase, participants ...string) {
+		b, err := readUntil(ola, model.PLAYER_LEFT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m model.PlayerLeft
+		json.Unmarshal(b, &m)
+		if m.Player != player || m.Phase != string(phase) || strings.Join(m.Participants, ",") != strings.Join(participants, ",") {
+			t.Errorf("FAIL - expected %s to leave in phase %s with %v left, got %+v", player, phase, participants, m)
+		}
+	}
+
+	// The voting closes when per leaves, since everyone else has voted
+	for name, target := range map[string]string{"ola": "kari", "kari": "ola"} {
+		conns[name].WriteJSON(model.PlayersVotesToQuestion{
+			PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+			Question:    1,
+			Votes:       map[string]int{target: 1},
+		})
+		if _, err := readUntil(conns[name], model.PLAYERS_VOTE_TO_QUESTION_RECIEVED); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conns["per"].Close()
+	expectPlayerLeft("per", game.Voting, "ola", "kari")
+	if _, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_DONE); err != nil {
+		t.Fatal(err)
+	}
+
+	// Players joining during the game wait for the next one
+	nils, err := joinHub(hubID.Hub, "nils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nils.Close()
+	nils.WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: 1, Decision: model.MOST_VOTES})
+	b, err := readUntil(nils, model.ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e model.Error
+	json.Unmarshal(b, &e)
+	if e.Code != model.ERR_NOT_PARTICIPANT {
+		t.Errorf("FAIL - expected error %s, got %+v", model.ERR_NOT_PARTICIPANT, e)
+	}
+
+	// The question is scored without kari when kari leaves before self-voting
+	ola.WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: 1, Decision: model.MOST_VOTES})
+	if _, err := readUntil(ola, model.SELF_VOTE_ON_QUESTION_RECEIVED); err != nil {
+		t.Fatal(err)
+	}
+	kari.Close()
+	expectPlayerLeft("kari", game.SelfVoting, "ola")
+	b, err = readUntil(ola, model.SELF_VOTE_ON_QUESTION_DONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var done model.SelfVoteOnQuestionDone
+	json.Unmarshal(b, &done)
+	if len(done.Points) != 1 || done.Points["ola"] != model.POINTS_MAX {
+		t.Errorf("FAIL - expected only ola to get %d points, got %v", model.POINTS_MAX, done.Points)
+	}
+	if _, err := readUntil(ola, model.GAME_FINISHED); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRejoin(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1, "minPlayers": 2, "votingSeconds": 0}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	join := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/join/" + hubID.Hub + "/ola"}
+	ola, success, err := dialHub(join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if success.Player != "ola" || success.SessionToken == "" {
+		t.Fatalf("FAIL - expected a session token for ola, got %+v", success)
+	}
+	kari, err := joinHub(hubID.Hub, "kari")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kari.Close()
+	for _, c := range []*websocket.Conn{ola, kari} {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+	if _, err := readUntil(ola, model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+	ola.WriteJSON(model.PlayersVotesToQuestion{
+		PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+		Question:    1,
+		Votes:       map[string]int{"kari": 1},
+	})
+	if _, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_RECIEVED); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection drops without a close message
+	ola.Close()
+	for {
+		b, err := readUntil(kari, model.LOBBY_ROSTER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var roster model.LobbyRoster
+		json.Unmarshal(b, &roster)
+		if len(roster.Players) == 2 && !roster.Players[0].Connected {
+			break
+		}
+	}
+
+	// The name is kept for ola
+	if _, err := joinHub(hubID.Hub, "ola"); err == nil {
+		t.Errorf("FAIL - expected the name ola to be taken while ola can rejoin")
+	}
+
+	rejoin := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/rejoin/" + hubID.Hub + "/ola"}
+	rejoin.RawQuery = "token=wrong"
+	if _, res, err := websocket.DefaultDialer.Dial(rejoin.String(), nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("FAIL - expected a wrong token to be unauthorized")
+	}
+
+	rejoin.RawQuery = "token=" + success.SessionToken
+	ola, again, err := dialHub(rejoin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	if !again.Rejoined || again.SessionToken != success.SessionToken {
+		t.Errorf("FAIL - expected to rejoin with the same token, got %+v", again)
+	}
+
+	b, err := readUntil(ola, model.GAME_STATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state model.GameState
+	json.Unmarshal(b, &state)
+	if state.Phase != string(game.Voting) || len(state.Questions) != 1 || state.Roster.Host != "ola" {
+		t.Fatalf("FAIL - invalid game state: %+v", state)
+	}
+	q := state.Questions[0]
+	if q.Text == "" || q.Votes["kari"] != 1 || len(q.Voted) != 1 || q.Voted[0] != "ola" {
+		t.Errorf("FAIL - expected the votes of ola in the game state, got %+v", q)
+	}
+
+	// The game goes on with the new connection
+	kari.WriteJSON(model.PlayersVotesToQuestion{
+		PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+		Question:    1,
+		Votes:       map[string]int{"ola": 1},
+	})
+	if _, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_DONE); err != nil {
+		t.Fatal(err)
+	}
+
+	// ola is removed when not rejoining within the grace period
+	ola.Close()
+	b, err = readUntil(kari, model.PLAYER_LEFT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left model.PlayerLeft
+	json.Unmarshal(b, &left)
+	if left.Player != "ola" {
+		t.Errorf("FAIL - expected ola to leave, got %+v", left)
+	}
+	if _, _, err := websocket.DefaultDialer.Dial(rejoin.String(), nil); err == nil {
+		t.Errorf("FAIL - expected rejoin to fail after the grace period")
+	}
+}
+
+func TestEmptyHubExpires(t *testing.T) {
+	defer seq()()
+
+	hubID, err := createHub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := game.GetGame(hubID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody joins, the hub and its game are removed after HUB_EMPTY_TTL
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := game.GetGame(hubID); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("FAIL - expected the empty hub to be closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := joinHub(hubID, "late"); err == nil {
+		t.Errorf("FAIL - expected joining a closed hub to fail")
+	}
+}
+
+func TestHubStats(t *testing.T) {
+	defer seq()()
+
+	if _, err := createHub(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := adminRequest("GET", "/admin/hubs", adminToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var stats model.HubStats
+	json.NewDecoder(res.Body).Decode(&stats)
+	if stats.CodeStyle != "digits" || stats.CodeLength != 5 || stats.TotalCodes != 100000 {
+		t.Errorf("FAIL - expected five digit codes, got %+v", stats)
+	}
+	if stats.ActiveHubs < 1 || stats.CodesRemaining != stats.TotalCodes-int64(stats.ActiveHubs) {
+		t.Errorf("FAIL - invalid number of codes remaining: %+v", stats)
+	}
+	if stats.SlowClients.Policy != "coalesce" || stats.SlowClients.QueueSize != 64 {
+		t.Errorf("FAIL - expected the default slow client policy, got %+v", stats.SlowClients)
+	}
+}
+
+func TestHostControls(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "minPlayers": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+	if hubID.HostToken == "" {
+		t.Fatal("FAIL - expected a host token")
+	}
+
+	// The creator becomes host even when joining after someone else
+	ola, err := joinHub(hubID.Hub, "ola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ola.Close()
+	kari, _, err := dialHub(url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/join/" + hubID.Hub + "/kari", RawQuery: "hostToken=" + hubID.HostToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kari.Close()
+
+	expectHost := func(conn *websocket.Conn, host string, locked bool) {
+		for {
+			b, err := readUntil(conn, model.LOBBY_ROSTER)
+			if err != nil {
+				t.Fatalf("FAIL - expected %s to be host - %s", host, err.Error())
+			}
+			var r model.LobbyRoster
+			json.Unmarshal(b, &r)
+			if r.Host == host && r.Locked == locked {
+				return
+			}
+		}
+	}
+	expectHost(ola, "kari", false)
+
+	// Only the host can use the host controls
+	ola.WriteJSON(model.LockLobby{PayloadType: model.PayloadType{Type: model.LOCK_LOBBY}, Locked: true})
+	b, err := readUntil(ola, model.ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e model.Error
+	json.Unmarshal(b, &e)
+	if e.Code != model.ERR_NOT_HOST {
+		t.Errorf("FAIL - expected error %s, got %+v", model.ERR_NOT_HOST, e)
+	}
+
+	// Nobody can join a locked lobby
+	kari.WriteJSON(model.LockLobby{PayloadType: model.PayloadType{Type: model.LOCK_LOBBY}, Locked: true})
+	expectHost(ola, "kari", true)
+	_, resp, err := websocket.DefaultDialer.Dial("ws://localhost:8080/join/"+hubID.Hub+"/per", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("FAIL - expected joining a locked lobby to be forbidden, got %v", err)
+	}
+	kari.WriteJSON(model.LockLobby{PayloadType: model.PayloadType{Type: model.LOCK_LOBBY}, Locked: false})
+	expectHost(ola, "kari", false)
+
+	// A kicked player is told why and can not join again
+	per, err := joinHub(hubID.Hub, "per")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer per.Close()
+	kari.WriteJSON(model.KickPlayer{PayloadType: model.PayloadType{Type: model.KICK_PLAYER}, Player: "per"})
+	if _, err := readUntil(per, model.KICKED); err != nil {
+		t.Fatal(err)
+	}
+	b, err = readUntil(ola, model.PLAYER_LEFT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left model.PlayerLeft
+	json.Unmarshal(b, &left)
+	if left.Player != "per" {
+		t.Errorf("FAIL - expected per to leave, got %+v", left)
+	}
+	if _, err := joinHub(hubID.Hub, "per"); err == nil {
+		t.Error("FAIL - expected a kicked player to not be able to join again")
+	}
+
+	// The new host can start the game before everyone is ready
+	kari.WriteJSON(model.TransferHost{PayloadType: model.PayloadType{Type: model.TRANSFER_HOST}, Player: "ola"})
+	expectHost(kari, "ola", false)
+	ola.WriteJSON(model.PayloadType{Type: model.START_GAME})
+	if _, err := readUntil(kari, model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+
+	// The host role passes on when the host does not rejoin in time
+	ola.Close()
+	expectHost(kari, "kari", false)
+}
+
+func TestSpectators(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1, "minPlayers": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	spectate := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/spectate/" + hubID.Hub}
+	tv, success, err := dialHub(spectate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tv.Close()
+	if success.Role != model.ROLE_SPECTATOR || success.Player == "" {
+		t.Errorf("FAIL - expected to attach as a spectator, got %+v", success)
+	}
+	if _, err := readUntil(tv, model.GAME_STATE); err != nil {
+		t.Fatal(err)
+	}
+
+	// The spectator is not counted when everyone is ready
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"ola", "kari"} {
+		c, err := joinHub(hubID.Hub, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[name] = c
+	}
+	for _, c := range conns {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+	if _, err := readUntil(tv, model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spectators can not play, and can not be voted on
+	tv.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	b, err := readUntil(tv, model.ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e model.Error
+	json.Unmarshal(b, &e)
+	if e.Code != model.ERR_SPECTATOR {
+		t.Errorf("FAIL - expected error %s, got %+v", model.ERR_SPECTATOR, e)
+	}
+	conns["ola"].WriteJSON(model.PlayersVotesToQuestion{
+		PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+		Question:    1,
+		Votes:       map[string]int{success.Player: 1},
+	})
+	b, err = readUntil(conns["ola"], model.ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(b, &e)
+	if e.Code != model.ERR_INVALID_TARGETS {
+		t.Errorf("FAIL - expected error %s, got %+v", model.ERR_INVALID_TARGETS, e)
+	}
+
+	// A spectator attaching mid-game gets the state of the game
+	late, _, err := dialHub(spectate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	b, err = readUntil(late, model.GAME_STATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state model.GameState
+	json.Unmarshal(b, &state)
+	if state.Phase != string(game.Voting) || len(state.Questions) != 1 || len(state.Roster.Players) != 2 || state.Roster.Spectators != 2 {
+		t.Errorf("FAIL - invalid game state for the spectator: %+v", state)
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1, "minPlayers": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	tv, success, err := dialHub(url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/display/" + hubID.Hub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tv.Close()
+	if success.Role != model.ROLE_DISPLAY {
+		t.Errorf("FAIL - expected to attach as a display, got %+v", success)
+	}
+
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"ola", "kari"} {
+		c, err := joinHub(hubID.Hub, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[name] = c
+	}
+	for _, c := range conns {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+
+	// The display follows the submissions
+	b, err := readUntil(tv, model.DISPLAY_PROGRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress model.DisplayProgress
+	json.Unmarshal(b, &progress)
+	if progress.Phase != string(game.Voting) || len(progress.Questions) != 1 || progress.Questions[0].Text == "" || len(progress.Questions[0].Waiting) != 2 {
+		t.Errorf("FAIL - expected to wait for both players, got %+v", progress)
+	}
+	for name, target := range map[string]string{"ola": "kari", "kari": "kari"} {
+		conns[name].WriteJSON(model.PlayersVotesToQuestion{
+			PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+			Question:    1,
+			Votes:       map[string]int{target: 1},
+		})
+		if _, err := readUntil(conns[name], model.PLAYERS_VOTE_TO_QUESTION_RECIEVED); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		b, err := readUntil(tv, model.DISPLAY_PROGRESS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(b, &progress)
+		if progress.Phase == string(game.SelfVoting) {
+			break
+		}
+	}
+	for name, decision := range map[string]string{"ola": model.LEAST_VOTES, "kari": model.MOST_VOTES} {
+		conns[name].WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: 1, Decision: decision})
+	}
+
+	// The votes are revealed with the most votes last
+	b, err = readUntil(tv, model.DISPLAY_REVEAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reveal model.DisplayReveal
+	json.Unmarshal(b, &reveal)
+	if len(reveal.Tallies) != 2 || reveal.Tallies[1].Player != "kari" || reveal.Tallies[1].Votes != 2 || reveal.Tallies[1].Step != 2 ||
+		len(reveal.MostVotes) != 1 || reveal.MostVotes[0] != "kari" || reveal.StepMillis <= 0 {
+		t.Errorf("FAIL - invalid reveal: %+v", reveal)
+	}
+	for {
+		b, err := readUntil(tv, model.DISPLAY_SCOREBOARD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var board model.DisplayScoreboard
+		json.Unmarshal(b, &board)
+		if board.Final {
+			if len(board.Standings) != 2 || board.Standings[0].Rank != 1 {
+				t.Errorf("FAIL - invalid scoreboard: %+v", board)
+			}
+			break
+		}
+	}
+
+	// The phones of the players only get the player messages
+	conns["ola"].SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, b, err := conns["ola"].ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p model.PayloadType
+		json.Unmarshal(b, &p)
+		if strings.HasPrefix(p.Type, "Display") {
+			t.Fatalf("FAIL - a player got %s", p.Type)
+		}
+		if p.Type == model.GAME_FINISHED {
+			break
+		}
+	}
+}
+
+func TestDisplayDoesNotSeeVotes(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1, "minPlayers": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	// The first display gets the ID display-1, so no player can have the name
+	if c, err := joinHub(hubID.Hub, "display-1"); err == nil {
+		c.Close()
+		t.Fatal("FAIL - expected a player named display-1 to be rejected")
+	}
+
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"ola", "kari"} {
+		c, err := joinHub(hubID.Hub, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[name] = c
+	}
+	for _, c := range conns {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+	if _, err := readUntil(conns["ola"], model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+	conns["ola"].WriteJSON(model.PlayersVotesToQuestion{
+		PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+		Question:    1,
+		Votes:       map[string]int{"kari": 1},
+	})
+	if _, err := readUntil(conns["ola"], model.PLAYERS_VOTE_TO_QUESTION_RECIEVED); err != nil {
+		t.Fatal(err)
+	}
+
+	// The display catches up on who voted, but not on the votes
+	tv, success, err := dialHub(url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/display/" + hubID.Hub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tv.Close()
+	if success.Player != "display-1" {
+		t.Errorf("FAIL - expected the ID display-1, got %+v", success)
+	}
+	b, err := readUntil(tv, model.GAME_STATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state model.GameState
+	json.Unmarshal(b, &state)
+	if len(state.Questions) != 1 || len(state.Questions[0].Voted) != 1 || state.Questions[0].Voted[0] != "ola" {
+		t.Fatalf("FAIL - expected ola to have voted, got %+v", state.Questions)
+	}
+	if q := state.Questions[0]; q.Votes != nil || q.Decision != "" {
+		t.Errorf("FAIL - expected the display to get no votes, got %+v", q)
+	}
+}
+
+func TestVotingClosesWithoutTargets(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1, "minPlayers": 2, "votingSeconds": 0, "allowSelfVote": false}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"ola", "kari"} {
+		c, err := joinHub(hubID.Hub, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[name] = c
+	}
+	for _, c := range conns {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+	ola := conns["ola"]
+	if _, err := readUntil(ola, model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody is left for ola to vote on, so the game stops waiting for the votes
+	conns["kari"].Close()
+	if _, err := readUntil(ola, model.PLAYER_LEFT); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_DONE); err != nil {
+		t.Fatalf("FAIL - expected the voting to close - %v", err)
+	}
+	ola.WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: 1, Decision: model.LEAST_VOTES})
+	if _, err := readUntil(ola, model.GAME_FINISHED); err != nil {
+		t.Fatalf("FAIL - expected the game to finish - %v", err)
+	}
+}
+
+func TestPlayerWithoutVotesHasLeastVotes(t *testing.T) {
+	defer seq()()
+
+	res, err := http.Post("http://localhost:8080/create", "application/json",
+		strings.NewReader(`{"language": "en", "game": {"numberOfQuestions": 1, "votesPerQuestion": 1, "minPlayers": 3}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hubID model.HubID
+	json.NewDecoder(res.Body).Decode(&hubID)
+	res.Body.Close()
+
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"ola", "kari", "per"} {
+		c, err := joinHub(hubID.Hub, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[name] = c
+	}
+	for _, c := range conns {
+		c.WriteJSON(model.ReadyToPlay{PayloadType: model.PayloadType{Type: model.READY_TO_PLAY}, Ready: true})
+	}
+	ola := conns["ola"]
+	if _, err := readUntil(ola, model.FOUR_QUESTIONS); err != nil {
+		t.Fatal(err)
+	}
+
+	// per gets two votes, ola one and kari none
+	for name, target := range map[string]string{"ola": "per", "kari": "per", "per": "ola"} {
+		conns[name].WriteJSON(model.PlayersVotesToQuestion{
+			PayloadType: model.PayloadType{Type: model.PLAYERS_VOTE_TO_QUESTION},
+			Question:    1,
+			Votes:       map[string]int{target: 1},
+		})
+	}
+	if _, err := readUntil(ola, model.PLAYERS_VOTE_TO_QUESTION_DONE); err != nil {
+		t.Fatal(err)
+	}
+	for name, decision := range map[string]string{"ola": model.NEUTRAL, "kari": model.LEAST_VOTES, "per": model.MOST_VOTES} {
+		conns[name].WriteJSON(model.SelfVoteOnQuestion{PayloadType: model.PayloadType{Type: model.SELF_VOTE_ON_QUESTION}, Question: 1, Decision: decision})
+	}
+	b, err := readUntil(ola, model.SELF_VOTE_ON_QUESTION_DONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var done model.SelfVoteOnQuestionDone
+	json.Unmarshal(b, &done)
+	want := map[string]int{"ola": model.POINTS_NEUTRAL, "kari": model.POINTS_MAX, "per": model.POINTS_MAX}
+	for p, points := range want {
+		if done.Points[p] != points {
+			t.Errorf("FAIL - expected %s to get %d points, got %v", p, points, done.Points)
+		}
+	}
+}
@@ -1,60 +1,318 @@
 package model
 
 import (
+	"fmt"
 	"github.com/gorilla/websocket"
 	"sync"
 )
 
 const (
+	CONNECTION_SUCCESS                = "ConnectionSuccess"
 	READY_TO_PLAY                     = "ReadyToPlay"
 	FOUR_QUESTIONS                    = "FourQuestions"
 	PLAYERS_VOTE_TO_QUESTION          = "PlayersVoteToQuestion"
 	PLAYERS_VOTE_TO_QUESTION_DONE     = "PlayersVoteToQuestionDone"
 	PLAYERS_VOTE_TO_QUESTION_RECIEVED = "PlayersVoteToQuestionReceived"
 	PLAYERS_CONNECTED                 = "PlayersConnected"
+	CHANGE_VOTE                       = "ChangeVote"
 	SELF_VOTE_ON_QUESTION             = "SelfVoteOnQuestion"
 	SELF_VOTE_ON_QUESTION_RECEIVED    = "SelfVoteOnQuestionReceived"
 	SELF_VOTE_ON_QUESTION_DONE        = "SelfVoteOnQuestionDone"
+	NO_MORE_QUESTIONS                 = "NoMoreQuestions"
+	GAME_FINISHED                     = "GameFinished"
+	PLAY_AGAIN                        = "PlayAgain"
+	PHASE_TIMER                       = "PhaseTimer"
+	TIME_UP                           = "TimeUp"
+	ERROR                             = "Error"
+	LOBBY_ROSTER                      = "LobbyRoster"
+	LATENCY                           = "Latency"
+	PLAYER_JOINED                     = "PlayerJoined"
+	PLAYER_LEFT                       = "PlayerLeft"
+	PLAYER_DISCONNECTED               = "PlayerDisconnected"
+	PLAYER_RECONNECTED                = "PlayerReconnected"
+	GAME_STATE                        = "GameState"
+	HUB_CLOSED                        = "HubClosed"
+	KICK_PLAYER                       = "KickPlayer"
+	KICKED                            = "Kicked"
+	LOCK_LOBBY                        = "LockLobby"
+	START_GAME                        = "StartGame"
+	TRANSFER_HOST                     = "TransferHost"
+	VIEWER_JOINED                     = "ViewerJoined"
+	VIEWER_LEFT                       = "ViewerLeft"
+	DISPLAY_PROGRESS                  = "DisplayProgress"
+	DISPLAY_REVEAL                    = "DisplayReveal"
+	DISPLAY_SCOREBOARD                = "DisplayScoreboard"
 	MOST_VOTES                        = "mostVotes"
 	NEUTRAL                           = "neutral"
 	LEAST_VOTES                       = "leastVotes"
 )
+
+// Codes in the Error payload
+const (
+	ERR_INVALID_MESSAGE    = "InvalidMessage"
+	ERR_UNKNOWN_TYPE       = "UnknownType"
+	ERR_WRONG_PHASE        = "WrongPhase"
+	ERR_INVALID_QUESTION   = "InvalidQuestion"
+	ERR_INVALID_VOTES      = "InvalidVotes"
+	ERR_ALREADY_VOTED      = "AlreadyVoted"
+	ERR_NOT_VOTED          = "NotVoted"
+	ERR_INVALID_TARGETS    = "InvalidTargets"
+	ERR_NOT_PARTICIPANT    = "NotParticipant"
+	ERR_NOT_HOST           = "NotHost"
+	ERR_INVALID_PLAYER     = "InvalidPlayer"
+	ERR_NOT_ENOUGH_PLAYERS = "NotEnoughPlayers"
+	ERR_SPECTATOR          = "Spectator"
+	ERR_INVALID_DECISION   = "InvalidDecision"
+	ERR_INTERNAL           = "InternalError"
+)
+
+// Default game settings
 const (
-	MAX_NUMBER_OF_ROUND = 4
-	POINTS_MAX          = 3
-	POINTS_NEUTRAL      = 1
-	POINTS_ZERO         = 0
+	MAX_NUMBER_OF_ROUND         = 4
+	REQUIRED_VOTES_PER_QUESTION = 2
+	POINTS_MAX                  = 3
+	POINTS_NEUTRAL              = 1
+	POINTS_ZERO                 = 0
+	MIN_PLAYERS                 = 1
+	VOTING_SECONDS              = 120
+	SELF_VOTING_SECONDS         = 60
+	MAX_PHASE_SECONDS           = 600
+)
+
+const DEFAULT_LANGUAGE = "no"
+
+// Close code sent to a client that is too slow to keep up with the messages
+const CLOSE_SLOW_CLIENT = 4008
+
+// Roles of the connections to a hub
+const (
+	ROLE_PLAYER    = "player"
+	ROLE_SPECTATOR = "spectator"
+	// A big screen that gets the display events on top of every broadcast
+	ROLE_DISPLAY = "display"
+	// Broadcasts to every role
+	ROLE_ALL = "all"
 )
 
 type HubID struct {
-	Hub string `json:"hub"`
+	Hub      string      `json:"hub"`
+	Settings HubSettings `json:"settings"`
+	// Join with '?hostToken=' to become host of the hub
+	HostToken string `json:"hostToken"`
+}
+
+// HubStats is the number of active hubs and how many hub IDs are left
+type HubStats struct {
+	ActiveHubs     int    `json:"activeHubs"`
+	CodeStyle      string `json:"codeStyle"`
+	CodeLength     int    `json:"codeLength"`
+	TotalCodes     int64  `json:"totalCodes"`
+	CodesRemaining int64  `json:"codesRemaining"`
+	// What happened to clients too slow to keep up since the server started
+	SlowClients SlowClientStats `json:"slowClients"`
+}
+
+// SlowClientStats counts the messages to slow clients that were dropped or
+// replaced by a newer message, and the clients that were disconnected
+type SlowClientStats struct {
+	Policy       string `json:"policy"`
+	QueueSize    int    `json:"queueSize"`
+	Dropped      int64  `json:"dropped"`
+	Coalesced    int64  `json:"coalesced"`
+	Disconnected int64  `json:"disconnected"`
+}
+
+// HubSettings is chosen by the client creating the hub and decides which
+// questions are played in the hub
+type HubSettings struct {
+	Language string       `json:"language"`
+	Category string       `json:"category,omitempty"`
+	Packs    []string     `json:"packs,omitempty"`
+	Game     GameSettings `json:"game"`
+}
+
+// GameSettings decides how the game in a hub is played
+type GameSettings struct {
+	NumberOfQuestions int `json:"numberOfQuestions"`
+	// Votes every player gives on each question
+	VotesPerQuestion int         `json:"votesPerQuestion"`
+	Points           PointsTable `json:"points"`
+	// Players needed before the game can start
+	MinPlayers int `json:"minPlayers"`
+	// Seconds the players have to vote on every question, 0 means no deadline
+	VotingSeconds int `json:"votingSeconds"`
+	// Seconds the players have to self-vote on every question, 0 means no deadline
+	SelfVotingSeconds int `json:"selfVotingSeconds"`
+	// If players can give votes to themselves
+	AllowSelfVote bool `json:"allowSelfVote"`
+}
+
+// PointsTable is the points given for a self vote on a question
+type PointsTable struct {
+	// Guessed correctly on mostVotes or leastVotes
+	Max int `json:"max"`
+	// Guessed correctly on neutral
+	Neutral int `json:"neutral"`
+	// Guessed wrong
+	Zero int `json:"zero"`
+}
+
+// DefaultGameSettings returns four questions, two votes each and 3/1/0 points
+func DefaultGameSettings() GameSettings {
+	return GameSettings{
+		NumberOfQuestions: MAX_NUMBER_OF_ROUND,
+		VotesPerQuestion:  REQUIRED_VOTES_PER_QUESTION,
+		Points: PointsTable{
+			Max:     POINTS_MAX,
+			Neutral: POINTS_NEUTRAL,
+			Zero:    POINTS_ZERO,
+		},
+		MinPlayers:        MIN_PLAYERS,
+		VotingSeconds:     VOTING_SECONDS,
+		SelfVotingSeconds: SELF_VOTING_SECONDS,
+		AllowSelfVote:     true,
+	}
+}
+
+// Validate checks that the settings are within sensible limits
+func (s GameSettings) Validate() error {
+	if s.NumberOfQuestions < 1 || s.NumberOfQuestions > 20 {
+		return fmt.Errorf("numberOfQuestions must be between 1-20, not %d", s.NumberOfQuestions)
+	}
+	if s.VotesPerQuestion < 1 || s.VotesPerQuestion > 10 {
+		return fmt.Errorf("votesPerQuestion must be between 1-10, not %d", s.VotesPerQuestion)
+	}
+	p := s.Points
+	if p.Zero < 0 || p.Neutral < p.Zero || p.Max < p.Neutral || p.Max > 100 {
+		return fmt.Errorf("points must be 0 <= zero <= neutral <= max <= 100, not %d/%d/%d", p.Zero, p.Neutral, p.Max)
+	}
+	if s.MinPlayers < 1 || s.MinPlayers > 50 {
+		return fmt.Errorf("minPlayers must be between 1-50, not %d", s.MinPlayers)
+	}
+	// A single player has nobody else to vote on
+	if !s.AllowSelfVote && s.MinPlayers < 2 {
+		return fmt.Errorf("minPlayers must be at least 2 when allowSelfVote is off, not %d", s.MinPlayers)
+	}
+	if s.VotingSeconds < 0 || s.VotingSeconds > MAX_PHASE_SECONDS {
+		return fmt.Errorf("votingSeconds must be between 0-%d, not %d", MAX_PHASE_SECONDS, s.VotingSeconds)
+	}
+	if s.SelfVotingSeconds < 0 || s.SelfVotingSeconds > MAX_PHASE_SECONDS {
+		return fmt.Errorf("selfVotingSeconds must be between 0-%d, not %d", MAX_PHASE_SECONDS, s.SelfVotingSeconds)
+	}
+	return nil
 }
 
 // NewPlayer is used by both /newGameRoom and /joinGameRoom
 type NewPlayer struct {
 	Name  string `json:"name"`
 	HubID string `json:"hubID"`
+	// Token from HubID that makes the player host
+	HostToken string `json:"hostToken,omitempty"`
 }
 
 type PlayerConnection struct {
 	Name string
 	Conn *websocket.Conn
+	// Token from HubID that makes the player host
+	HostToken string
 }
 
 type Message struct {
 	Player string `json:"player,omitempty"` // name of player who sent the message
 	Text   string `json:"text"`
+	// Set instead of Text when the hub tells the game that the player
+	// joined or left, e.g. PLAYER_JOINED
+	Event string `json:"-"`
+}
+
+// Sent by the host to remove a player from the hub. The player can not join again
+type KickPlayer struct {
+	PayloadType
+	Player string `json:"player"`
+}
+
+// Sent to the kicked player before the connection is closed
+type Kicked struct {
+	PayloadType
+	Reason string `json:"reason"`
+}
+
+// Sent by the host to stop new players from joining, or let them join again
+type LockLobby struct {
+	PayloadType
+	Locked bool `json:"locked"`
+}
+
+// Sent by the host to make another player host
+type TransferHost struct {
+	PayloadType
+	Player string `json:"player"`
+}
+
+// Sent to every connected client before the hub is closed
+type HubClosed struct {
+	PayloadType
+	Reason string `json:"reason"`
 }
 
 // Sent after the client is successfully connected with a websocket
 type ConnSuccess struct {
 	PayloadType
+	Player string `json:"player"`
+	// Used to rejoin the hub after losing the connection
+	SessionToken string `json:"sessionToken"`
+	// The connection replaced an earlier connection of the player
+	Rejoined bool `json:"rejoined,omitempty"`
+	// Spectators and displays get broadcasts but can not play
+	Role string `json:"role"`
 }
 type PlayersConnected struct {
 	PayloadType
 	NumberConnected int `json:"numberConnected"`
 }
 
+// Broadcasted every time a player joins, leaves or changes ready state
+type LobbyRoster struct {
+	PayloadType
+	// Players in the order they joined
+	Players     []RosterPlayer `json:"players"`
+	Host        string         `json:"host"`
+	NumberReady int            `json:"numberReady"`
+	// New players can not join
+	Locked bool `json:"locked"`
+	// Number of spectators and displays watching the hub
+	Spectators int `json:"spectators"`
+	Displays   int `json:"displays"`
+}
+
+// Broadcasted when a player leaves the hub. Votes and self votes the player
+// already gave are still counted, but the game no longer waits for the player
+type PlayerLeft struct {
+	PayloadType
+	Player string `json:"player"`
+	Phase  string `json:"phase"`
+	// Players in the game who are still in the hub
+	Participants []string `json:"participants"`
+}
+
+type RosterPlayer struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	Host  bool   `json:"host"`
+	// False while the player has lost the connection and can rejoin
+	Connected bool `json:"connected"`
+	// Round trip time of the last ping in milliseconds, 0 until it is measured
+	LatencyMs int64 `json:"latencyMs"`
+}
+
+// Sent to everyone in the hub at most once per ping interval, so the latency
+// in the roster stays current
+type Latency struct {
+	PayloadType
+	// Round trip time of the last ping in milliseconds, keyed by player
+	LatencyMs map[string]int64 `json:"latencyMs"`
+}
+
 type ReadyToPlay struct {
 	PayloadType
 	Ready  bool   `json:"ready"`
@@ -65,24 +323,55 @@ type PayloadType struct {
 	Type string `json:"payloadtype,omitempty"`
 }
 
-// Clients sends this to the server for voting on a question
+// PayloadName returns the payload type. Every message embedding PayloadType
+// gets the method, so the hub can tell the messages apart
+func (p PayloadType) PayloadName() string {
+	return p.Type
+}
+
+// Sent to a client when a message from it is rejected
+type Error struct {
+	PayloadType
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Phase of the game when the message was rejected
+	Phase string `json:"phase,omitempty"`
+	// Payload type of the rejected message
+	RejectedType string `json:"rejectedType,omitempty"`
+	// Names in the votes that can not be voted on
+	InvalidTargets []string `json:"invalidTargets,omitempty"`
+}
+
+// Clients sends this to the server for voting on a question. The same struct
+// is sent with the payload type 'ChangeVote' to replace the votes
 type PlayersVotesToQuestion struct {
 	PayloadType
 	Question int            `json:"questionNumber"`
 	Votes    map[string]int `json:"votes"`
 }
 
-// Server broadcasts this struct after received 'PlayersVotesToQuestion'
+// Server broadcasts this struct after received 'PlayersVotesToQuestion' or 'ChangeVote'
 type PlayersVotesToQuestionReceived struct {
 	PayloadType
 	Question int    `json:"questionNumber"`
 	Player   string `json:"player"`
+	// The player replaced the earlier votes on the question
+	Changed bool `json:"changed,omitempty"`
 }
 
+// Sent when the game starts. The payload type is 'FourQuestions', but the
+// number of questions is decided by GameSettings
 type Questions struct {
 	PayloadType
 	Question []string `json:"questions"`
 }
+
+// Broadcasted when the hub has played every question matching its settings
+type NoMoreQuestions struct {
+	PayloadType
+	QuestionsPlayed int    `json:"questionsPlayed"`
+	Message         string `json:"message"`
+}
 type Client struct {
 	Conn  *websocket.Conn
 	mutex *sync.RWMutex
@@ -108,4 +397,152 @@ type SelfVoteOnQuestionDone struct {
 	Question int `json:"questionNumber"`
 	// map of playerName and how many points
 	Points map[string]int `json:"points"`
+	// Running score of every player after this question
+	Totals map[string]int `json:"totals"`
+}
+
+// Broadcasted when a phase with a deadline starts and every second until
+// the deadline
+type PhaseTimer struct {
+	PayloadType
+	Phase       string `json:"phase"`
+	SecondsLeft int    `json:"secondsLeft"`
+	// Unix time in milliseconds
+	Deadline int64 `json:"deadline"`
+}
+
+// Broadcasted when the deadline of a phase runs out before every player
+// submitted. Missing votes are not counted, missing self votes give zero points
+type TimeUp struct {
+	PayloadType
+	Phase   string   `json:"phase"`
+	Missing []string `json:"missing"`
+	Message string   `json:"message"`
+}
+
+// Sent to a player who rejoins the hub, with everything needed to show the game again
+type GameState struct {
+	PayloadType
+	Player   string      `json:"player"`
+	Phase    string      `json:"phase"`
+	Settings HubSettings `json:"settings"`
+	// Number of the current game in the hub, starting at 1
+	Game   int         `json:"game"`
+	Roster LobbyRoster `json:"roster"`
+	// The questions of the current game, empty in the lobby
+	Questions []QuestionState `json:"questions"`
+	// Running score of the current game
+	Totals map[string]int `json:"totals"`
+	// Time left of the current phase, if it has a deadline
+	Timer   *PhaseTimer  `json:"timer,omitempty"`
+	History []GameResult `json:"history"`
+}
+
+// QuestionState is the progress on one question in the current game
+type QuestionState struct {
+	Question int    `json:"questionNumber"`
+	Text     string `json:"text"`
+	// Players who have voted and self-voted on the question
+	Voted     []string `json:"voted"`
+	SelfVoted []string `json:"selfVoted"`
+	// The votes and self vote of the player who rejoined
+	Votes    map[string]int `json:"votes,omitempty"`
+	Decision string         `json:"decision,omitempty"`
+	// Set when the question is scored
+	Points map[string]int `json:"points,omitempty"`
+}
+
+// Broadcasted when the last question is scored
+type GameFinished struct {
+	PayloadType
+	// Number of the game in the hub, starting at 1
+	Game int `json:"game"`
+	// Players sorted by points, highest first
+	Standings []Standing `json:"standings"`
+	// Every player with rank 1
+	Winners []string `json:"winners"`
+	// More than one player shares the first place
+	Tie       bool             `json:"tie"`
+	Questions []QuestionResult `json:"questions"`
+}
+
+// Sent by a client in the Results phase to play a new game in the same hub.
+// Broadcasted with the results of every game played so far
+type PlayAgain struct {
+	PayloadType
+	Player string `json:"player,omitempty"`
+	// Number of the game that is about to start
+	Game    int          `json:"game"`
+	History []GameResult `json:"history"`
+}
+
+// GameResult is the final standings of a game played in the hub
+type GameResult struct {
+	Game      int        `json:"game"`
+	Standings []Standing `json:"standings"`
+	Winners   []string   `json:"winners"`
+}
+
+type Standing struct {
+	// Players with the same points share the rank
+	Rank   int    `json:"rank"`
+	Player string `json:"player"`
+	Points int    `json:"points"`
+}
+
+// QuestionResult is the votes, self votes and points on one question
+type QuestionResult struct {
+	Question  int               `json:"questionNumber"`
+	Text      string            `json:"text"`
+	Votes     map[string]int    `json:"votes"`
+	Decisions map[string]string `json:"decisions"`
+	Points    map[string]int    `json:"points"`
+}
+
+// Sent to displays when a phase with submissions starts and every time a
+// player submits or leaves
+type DisplayProgress struct {
+	PayloadType
+	Phase     string             `json:"phase"`
+	Questions []QuestionProgress `json:"questions"`
+}
+
+// QuestionProgress is who has and has not submitted on one question
+type QuestionProgress struct {
+	Question  int      `json:"questionNumber"`
+	Text      string   `json:"text"`
+	Submitted []string `json:"submitted"`
+	Waiting   []string `json:"waiting"`
+}
+
+// Sent to displays when a question is scored. The tallies are in the order
+// they should be revealed, fewest votes first
+type DisplayReveal struct {
+	PayloadType
+	Question int         `json:"questionNumber"`
+	Text     string      `json:"text"`
+	Tallies  []VoteTally `json:"tallies"`
+	// Players with the most votes, revealed last and highlighted
+	MostVotes []string `json:"mostVotes"`
+	// How long each tally is shown before the next is revealed
+	StepMillis int `json:"stepMillis"`
+}
+
+// VoteTally is the votes, self vote and points of one player on a question
+type VoteTally struct {
+	// Position in the reveal, starting at 1
+	Step     int    `json:"step"`
+	Player   string `json:"player"`
+	Votes    int    `json:"votes"`
+	Decision string `json:"decision"`
+	Points   int    `json:"points"`
+}
+
+// Sent to displays after every scored question, and with Final set when the
+// game is finished
+type DisplayScoreboard struct {
+	PayloadType
+	Game      int        `json:"game"`
+	Standings []Standing `json:"standings"`
+	Final     bool       `json:"final"`
 }
@@ -0,0 +1,179 @@
+// Package questionpack reads and writes question packs as CSV or JSON files.
+//
+// CSV files have a header row with the columns 'text', 'language' and
+// optionally 'category'. JSON files look like
+//
+//	{"slug": "work-team", "name": "Work team", "questions": [{"text": "...", "language": "en", "category": "work"}]}
+package questionpack
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/selvinnsikt/backend/database"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// File is the content of a question pack file
+type File struct {
+	Slug      string     `json:"slug,omitempty"`
+	Name      string     `json:"name,omitempty"`
+	Questions []Question `json:"questions"`
+}
+
+// Question is one question in a question pack file
+type Question struct {
+	Text     string `json:"text"`
+	Language string `json:"language"`
+	Category string `json:"category,omitempty"`
+}
+
+// ValidFormat checks that the format is csv or json
+func ValidFormat(format string) error {
+	if format != FormatCSV && format != FormatJSON {
+		return fmt.Errorf("'%s' is not a valid format, must be '%s' or '%s'", format, FormatCSV, FormatJSON)
+	}
+	return nil
+}
+
+// Read parses the file into rows that can be imported. Rows that can not be
+// parsed are returned as row errors, an error is only returned if the file
+// as a whole is unreadable
+func Read(r io.Reader, format string) (File, []database.ImportRow, []database.RowError, error) {
+	switch format {
+	case FormatCSV:
+		return readCSV(r)
+	case FormatJSON:
+		return readJSON(r)
+	default:
+		return File{}, nil, nil, ValidFormat(format)
+	}
+}
+
+// Write writes the pack and its questions in the given format
+func Write(w io.Writer, format string, p database.Pack, questions []database.Question) error {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"text", "language", "category"})
+		for _, q := range questions {
+			cw.Write([]string{q.Text, q.Language, q.Category})
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatJSON:
+		f := File{Slug: p.Slug, Name: p.Name, Questions: make([]Question, len(questions))}
+		for i, q := range questions {
+			f.Questions[i] = Question{Text: q.Text, Language: q.Language, Category: q.Category}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(f)
+	default:
+		return ValidFormat(format)
+	}
+}
+
+// Import reads the file and imports the questions into the pack. The slug and
+// name of the pack are taken from a json file if they are not given. Row errors from
+// reading the file and from the database are reported together
+func Import(db database.DB, r io.Reader, format string, p database.Pack, dryRun bool) (database.ImportReport, error) {
+	f, rows, rowErrors, err := Read(r, format)
+	if err != nil {
+		return database.ImportReport{}, &database.ValidationError{Field: "file", Message: err.Error()}
+	}
+	if p.Slug == "" {
+		p.Slug = f.Slug
+	}
+	if p.Name == "" {
+		p.Name = f.Name
+	}
+
+	report, err := db.ImportQuestions(p, rows, dryRun)
+	if err != nil {
+		return report, err
+	}
+	report.Rows += len(rowErrors)
+	report.Errors = append(report.Errors, rowErrors...)
+	sort.Slice(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Row < report.Errors[j].Row
+	})
+	return report, nil
+}
+
+// readCSV reads the header to find the columns. Row numbers are the rows of
+// the spreadsheet, the header is row 1
+func readCSV(r io.Reader) (File, []database.ImportRow, []database.RowError, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return File{}, nil, nil, fmt.Errorf("unable to read the csv header: %s", err.Error())
+	}
+	columns := make(map[string]int)
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, c := range []string{"text", "language"} {
+		if _, ok := columns[c]; !ok {
+			return File{}, nil, nil, fmt.Errorf("the csv header is missing the column '%s'", c)
+		}
+	}
+	column := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []database.ImportRow
+	var rowErrors []database.RowError
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, database.RowError{Row: row, Message: err.Error()})
+			continue
+		}
+		// Skip empty lines in the spreadsheet
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		rows = append(rows, database.ImportRow{Row: row, Question: database.Question{
+			Text:     column(record, "text"),
+			Language: column(record, "language"),
+			Category: column(record, "category"),
+		}})
+	}
+	return File{}, rows, rowErrors, nil
+}
+
+// readJSON reads a pack file. Row numbers are the position in the list of
+// questions, starting at 1
+func readJSON(r io.Reader) (File, []database.ImportRow, []database.RowError, error) {
+	var f File
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return f, nil, nil, fmt.Errorf("unable to parse the json file: %s", err.Error())
+	}
+	rows := make([]database.ImportRow, len(f.Questions))
+	for i, q := range f.Questions {
+		rows[i] = database.ImportRow{Row: i + 1, Question: database.Question{
+			Text:     q.Text,
+			Language: q.Language,
+			Category: q.Category,
+		}}
+	}
+	return f, rows, nil, nil
+}